@@ -0,0 +1,189 @@
+package main
+
+import (
+	"crypto/md5"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"hash"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Authenticating to the safe
+//
+// Basic auth is the default, since that's what the safe firmware
+// does.  Safes behind other web servers may want a Bearer token, or
+// HTTP Digest (RFC 7616) which we do as a challenge/response: send the
+// request without credentials, then answer the 401's challenge.  If
+// Basic is refused with a Digest challenge we answer that too, so
+// -auth digest is only needed to skip the Basic attempt.  Either way the
+// challenge is kept, and later requests answer it straight away; the
+// safe tells us with another 401 when it wants a new one.
+//
+//////////////////////////////////////////////////////////////////////
+
+var auth_method, token string
+
+// The last Digest challenge the safe sent, and how many requests have
+// answered it (the nonce count)
+var digest_last string
+var digest_count int
+
+func check_auth_method() error {
+	switch auth_method {
+	case "basic", "digest":
+		return nil
+	case "bearer":
+		if token == "" {
+			return errors.New("-auth bearer needs a -token")
+		}
+		return nil
+	}
+	return errors.New("Unknown -auth method " + auth_method + "; use basic, digest or bearer")
+}
+
+// Add whatever credentials can be sent up front.  Once the safe has
+// asked for Digest that's all we send it, rather than Basic again.
+func set_auth(req *http.Request, user, pass string) {
+	switch auth_method {
+	case "basic", "digest":
+		if digest_last != "" {
+			digest_count++
+			hdr, err := digest_authorization(digest_last, digest_count, req.Method, req.URL.RequestURI(), user, pass)
+			if err == nil {
+				req.Header.Set("Authorization", hdr)
+				return
+			}
+		}
+		if auth_method == "basic" {
+			req.SetBasicAuth(user, pass)
+		}
+	case "bearer":
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+}
+
+// The Digest challenge in a 401, if there is one.  A server may offer
+// more than one way to authenticate, each in its own header.
+func digest_challenge(resp *http.Response) (string, bool) {
+	for _, c := range resp.Header.Values("WWW-Authenticate") {
+		if strings.HasPrefix(strings.ToLower(c), "digest ") {
+			return c, true
+		}
+	}
+	return "", false
+}
+
+// Split a WWW-Authenticate Digest challenge into its parameters.
+// Values may be quoted, and quoted values may contain commas.
+func parse_challenge(header string) (map[string]string, bool) {
+	if !strings.HasPrefix(strings.ToLower(header), "digest ") {
+		return nil, false
+	}
+	rest := header[len("digest "):]
+	res := make(map[string]string)
+	for {
+		rest = strings.TrimLeft(rest, " ,")
+		if rest == "" {
+			break
+		}
+		eq := strings.Index(rest, "=")
+		if eq == -1 {
+			break
+		}
+		key := strings.ToLower(strings.TrimSpace(rest[:eq]))
+		rest = rest[eq+1:]
+
+		var val string
+		if strings.HasPrefix(rest, `"`) {
+			end := strings.Index(rest[1:], `"`)
+			if end == -1 {
+				return nil, false
+			}
+			val = rest[1 : end+1]
+			rest = rest[end+2:]
+		} else {
+			end := strings.Index(rest, ",")
+			if end == -1 {
+				end = len(rest)
+			}
+			val = strings.TrimSpace(rest[:end])
+			rest = rest[end:]
+		}
+		res[key] = val
+	}
+	return res, res["nonce"] != ""
+}
+
+// Work out the Authorization header answering a Digest challenge for
+// the count'th time
+func digest_authorization(challenge string, count int, method, uri, user, pass string) (string, error) {
+	c, ok := parse_challenge(challenge)
+	if !ok {
+		return "", errors.New("Safe did not send a usable Digest challenge")
+	}
+
+	algo := c["algorithm"]
+	if algo == "" {
+		algo = "MD5"
+	}
+	var h func() hash.Hash
+	switch strings.ToUpper(strings.TrimSuffix(strings.ToLower(algo), "-sess")) {
+	case "MD5":
+		h = md5.New
+	case "SHA-256":
+		h = sha256.New
+	default:
+		return "", errors.New("Unsupported Digest algorithm " + algo)
+	}
+	hs := func(s string) string {
+		d := h()
+		d.Write([]byte(s))
+		return hex.EncodeToString(d.Sum(nil))
+	}
+
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	cnonce := hex.EncodeToString(b)
+	nonce := c["nonce"]
+	nc := strconv.FormatInt(int64(count), 16)
+	nc = strings.Repeat("0", 8-len(nc)) + nc
+
+	ha1 := hs(user + ":" + c["realm"] + ":" + pass)
+	if strings.HasSuffix(strings.ToLower(algo), "-sess") {
+		ha1 = hs(ha1 + ":" + nonce + ":" + cnonce)
+	}
+	ha2 := hs(method + ":" + uri)
+
+	// We only do qop=auth; if that isn't offered fall back to the
+	// original RFC 2069 form
+	qop := ""
+	for _, q := range strings.Split(c["qop"], ",") {
+		if strings.TrimSpace(q) == "auth" {
+			qop = "auth"
+		}
+	}
+
+	var response string
+	if qop != "" {
+		response = hs(ha1 + ":" + nonce + ":" + nc + ":" + cnonce + ":" + qop + ":" + ha2)
+	} else {
+		response = hs(ha1 + ":" + nonce + ":" + ha2)
+	}
+
+	res := `Digest username="` + user + `", realm="` + c["realm"] + `", nonce="` + nonce + `", uri="` + uri + `", algorithm=` + algo + `, response="` + response + `"`
+	if qop != "" {
+		res += `, qop=` + qop + `, nc=` + nc + `, cnonce="` + cnonce + `"`
+	}
+	if c["opaque"] != "" {
+		res += `, opaque="` + c["opaque"] + `"`
+	}
+	return res, nil
+}
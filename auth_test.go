@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func md5_hex(s string) string {
+	sum := md5.Sum([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+// A safe that takes Basic and/or Digest for bob/pw, offering the given
+// WWW-Authenticate headers when it refuses a request.  Each nonce is
+// only good for two requests, after which it's stale.
+type auth_server struct {
+	basic, digest bool
+	offer         []string
+	t             *testing.T
+
+	nonce      int
+	uses       int
+	last_nc    int64
+	got_basic  int
+	got_digest int
+}
+
+func (a *auth_server) check_digest(r *http.Request) bool {
+	c, ok := parse_challenge(r.Header.Get("Authorization"))
+	if !ok || c["nonce"] != "n"+strconv.Itoa(a.nonce) || c["opaque"] != "op" {
+		return false
+	}
+	nc, err := strconv.ParseInt(c["nc"], 16, 64)
+	if err != nil || nc <= a.last_nc {
+		a.t.Errorf("nonce count went from %d to %s", a.last_nc, c["nc"])
+		return false
+	}
+	a.last_nc = nc
+	ha1 := md5_hex("bob:safe:pw")
+	ha2 := md5_hex(r.Method + ":" + r.URL.RequestURI())
+	return c["username"] == "bob" && c["uri"] == r.URL.RequestURI() &&
+		c["response"] == md5_hex(ha1+":"+c["nonce"]+":"+c["nc"]+":"+c["cnonce"]+":auth:"+ha2)
+}
+
+func (a *auth_server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	hdr := r.Header.Get("Authorization")
+	if user, pass, ok := r.BasicAuth(); ok {
+		a.got_basic++
+		if a.basic && user == "bob" && pass == "pw" {
+			fmt.Fprint(w, "Safe is unlocked")
+			return
+		}
+	}
+	stale := false
+	if strings.HasPrefix(hdr, "Digest ") {
+		a.got_digest++
+		if a.digest && a.check_digest(r) {
+			a.uses++
+			if a.uses <= 2 {
+				fmt.Fprint(w, "Safe is unlocked")
+				return
+			}
+			stale = true
+		}
+	}
+	a.nonce++
+	a.uses, a.last_nc = 0, 0
+	for _, o := range a.offer {
+		if strings.HasPrefix(o, "Digest ") {
+			o += `, nonce="n` + strconv.Itoa(a.nonce) + `"`
+			if stale {
+				o += ", stale=true"
+			}
+		}
+		w.Header().Add("WWW-Authenticate", o)
+	}
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+}
+
+const test_digest = `Digest realm="safe", qop="auth", opaque="op"`
+
+func TestAuth(t *testing.T) {
+	tests := []struct {
+		name        string
+		auth        string
+		server      auth_server
+		basic, dgst int
+	}{
+		{"Basic only", "basic", auth_server{basic: true, offer: []string{`Basic realm="safe"`}}, 5, 0},
+		{"Digest only", "basic", auth_server{digest: true, offer: []string{test_digest}}, 1, 5},
+		{"Digest only, -auth digest", "digest", auth_server{digest: true, offer: []string{test_digest}}, 0, 5},
+		{"both, Basic taken", "basic", auth_server{basic: true, digest: true, offer: []string{`Basic realm="safe"`, test_digest}}, 5, 0},
+		{"several headers, Digest last", "basic", auth_server{digest: true, offer: []string{`Basic realm="safe"`, `Negotiate`, test_digest}}, 1, 5},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tt.server.t = t
+			srv := httptest.NewServer(&tt.server)
+			defer srv.Close()
+			use_test_safe(t, srv.URL)
+			username, passwd, auth_method = "bob", "pw", tt.auth
+
+			for i := 0; i < 5; i++ {
+				if res, err := safe_request("status=1"); err != nil || res != "Safe is unlocked" {
+					t.Fatalf("request %d: safe_request = %q, %v", i+1, res, err)
+				}
+			}
+			if tt.server.got_basic != tt.basic {
+				t.Errorf("Basic credentials sent %d times, want %d", tt.server.got_basic, tt.basic)
+			}
+			// Stale nonces are answered again, so there can be more
+			// Digest attempts than requests, but at least one each
+			if tt.server.got_digest < tt.dgst || (tt.dgst == 0 && tt.server.got_digest != 0) {
+				t.Errorf("Digest sent %d times, want at least %d", tt.server.got_digest, tt.dgst)
+			}
+		})
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// BMP lock images
+//
+// A BMP is a 14 byte file header ("BM", the file size, two reserved
+// 16 bit fields and the offset of the pixels), an info header and the
+// pixels.  There's nowhere in it for text, so the payload goes after
+// the pixels, where viewers don't look.  The file size in the header
+// still says where the image ends, and the reserved fields, which
+// should be 0, mark the file as ours and say how long the payload is.
+//
+//////////////////////////////////////////////////////////////////////
+
+// In the first reserved field, "PL"
+const bmp_marker = 0x4c50
+
+type BMP struct {
+	data    []byte // the header and pixels
+	payload []byte // after the pixels, if we put one there
+	trailer []byte // anything else that was after the pixels
+}
+
+func is_bmp(data []byte) bool {
+	return len(data) >= 2 && data[0] == 'B' && data[1] == 'M'
+}
+
+func parse_bmp(img []byte) (BMP, error) {
+	var image BMP
+	if !is_bmp(img) || len(img) < 26 {
+		return image, errors.New("Not a BMP file")
+	}
+	header := binary.LittleEndian.Uint32(img[14:])
+	pixels := int(binary.LittleEndian.Uint32(img[10:]))
+	if header < 12 || 14+int(header) > len(img) || pixels < 14+int(header) || pixels > len(img) {
+		return image, errors.New("Bad BMP - damaged header")
+	}
+
+	// Some programs leave the size as 0, or get it wrong
+	end := int(binary.LittleEndian.Uint32(img[2:]))
+	mine := binary.LittleEndian.Uint16(img[6:]) == bmp_marker
+	if end < pixels || end > len(img) {
+		if mine {
+			return image, errors.New("Bad BMP - file size " + strconv.Itoa(end) + " in the header is wrong")
+		}
+		end = len(img)
+	}
+	image.data = img[:end]
+	image.trailer = img[end:]
+
+	if mine {
+		size := int(binary.LittleEndian.Uint16(img[8:]))
+		if size > len(image.trailer) {
+			return image, errors.New("Bad BMP - the password after the image is cut short")
+		}
+		image.payload = image.trailer[:size]
+		image.trailer = image.trailer[size:]
+	}
+	return image, nil
+}
+
+func write_bmp(f io.Writer, image BMP) error {
+	for _, b := range [][]byte{image.data, image.payload, image.trailer} {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Replace any old payload with a new one
+func embed_bmp_password(image *BMP, payload []byte) error {
+	if len(payload) > 0xffff {
+		return errors.New("The password is too big to add to a BMP")
+	}
+
+	// A copy, so the header can be changed without touching the source
+	head := append([]byte{}, image.data[:14]...)
+	binary.LittleEndian.PutUint32(head[2:], uint32(len(image.data)))
+	binary.LittleEndian.PutUint16(head[6:], bmp_marker)
+	binary.LittleEndian.PutUint16(head[8:], uint16(len(payload)))
+	image.data = append(head, image.data[14:]...)
+	image.payload = payload
+	return nil
+}
+
+// Find the password after a BMP's pixels
+func extract_bmp_password(image BMP) (LockInfo, error) {
+	if !is_payload(image.payload) {
+		return LockInfo{}, no_payload
+	}
+	_, info, err := decode_payload(image.payload)
+	return info, err
+}
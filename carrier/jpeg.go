@@ -0,0 +1,262 @@
+// Package carrier reads and writes JPEG files a segment at a time, so
+// a comment can be added or replaced without touching anything else in
+// the file.
+package carrier
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// JPEG file handling
+//
+//////////////////////////////////////////////////////////////////////
+
+// Marker byte (after the 0xff) of a comment segment
+const COM = 0xfe
+
+// A marker segment; the marker is the byte after the 0xff.  Anything we
+// don't need to understand (APPn, DRI, comments...) is kept as one of
+// these and written back in the same place.
+type Segment struct {
+	Marker int
+	Data   []byte
+}
+
+// One SOS and the image data after it, along with any segments (e.g.
+// more Huffman tables) between it and the previous scan
+type Scan struct {
+	Segments []Segment
+	SOS      []byte
+	Data     []byte
+}
+
+// Everything before the image data is kept in order, so EXIF, ICC
+// profiles and so on are written back as they were.  Trailer is
+// anything found after the end of the image.
+type JPEG struct {
+	Segments []Segment
+	Scans    []Scan
+	Trailer  []byte
+}
+
+// For error messages, e.g. 0x1f
+func byte_str(b byte) string {
+	return fmt.Sprintf("0x%02x", b)
+}
+
+func read_segment(img []byte, offset int) (int, int, []byte, error) {
+	var segment int
+	var size int
+	var res []byte
+	if offset+4 > len(img) {
+		return 0, 0, nil, errors.New("Bad JPEG - file ends at offset " + strconv.Itoa(len(img)) + " in the middle of a segment header at " + strconv.Itoa(offset))
+	}
+	if img[offset] != 0xff {
+		return 0, 0, nil, errors.New("Bad JPEG - expected 0xff at offset " + strconv.Itoa(offset) + ", found " + byte_str(img[offset]))
+	}
+	segment = int(img[offset+1])
+	size = int(img[offset+2])*256 + int(img[offset+3])
+	if size < 2 {
+		return 0, 0, nil, errors.New("Bad JPEG - segment " + byte_str(byte(segment)) + " at offset " + strconv.Itoa(offset) + " has a size of " + strconv.Itoa(size) + ", less than its own length field")
+	}
+	if offset+2+size > len(img) {
+		return 0, 0, nil, errors.New("Bad JPEG - segment " + byte_str(byte(segment)) + " at offset " + strconv.Itoa(offset) + " is " + strconv.Itoa(size) + " bytes, which runs past the end of the file at " + strconv.Itoa(len(img)))
+	}
+	res = img[offset+4 : offset+2+size]
+	return segment, size, res, nil
+}
+
+func write_segment(f io.Writer, marker int, data []byte) {
+	var buf [4]byte
+	l := len(data) + 2
+	buf[0] = 0xff
+	buf[1] = byte(marker)
+	buf[2] = byte(l >> 8)
+	buf[3] = byte(l & 255)
+	f.Write(buf[:4])
+	f.Write(data)
+}
+
+// A DRI (restart interval) segment is just a 2 byte count; if it's any
+// other size decoders will lose track of the RST markers in the scans
+func check_segment(marker int, data []byte) error {
+	if marker == 0xdd && len(data) != 2 {
+		return errors.New("Bad JPEG - DRI segment is " + strconv.Itoa(len(data)) + " bytes, should be 2")
+	}
+	return nil
+}
+
+// Find where the entropy coded data after an SOS ends.  In it a 0xff is
+// followed by 0x00 (a stuffed byte), a restart marker or another 0xff
+// (fill); anything else is a real marker.
+func scan_end(img []byte, offset int) int {
+	for i := offset; i < len(img)-1; i++ {
+		if img[i] != 0xff {
+			continue
+		}
+		next := img[i+1]
+		if next == 0x00 || (next >= 0xd0 && next <= 0xd7) {
+			i++
+			continue
+		}
+		if next == 0xff {
+			continue
+		}
+		return i
+	}
+	return -1
+}
+
+// Split a JPEG file into its segments and scans
+func Parse(img []byte) (JPEG, error) {
+	var image JPEG
+
+	if len(img) < 2 {
+		return image, errors.New("Image is not a JPEG - the file ends at offset " + strconv.Itoa(len(img)) + ", before the 0xff 0xd8 header is complete")
+	}
+	if img[0] != 0xff || img[1] != 0xd8 {
+		return image, errors.New("Image is not a JPEG - bad header: expected 0xff 0xd8 at offset 0, found " + byte_str(img[0]) + " " + byte_str(img[1]))
+	}
+	offset := 2
+
+	for {
+		section, size, data, err := read_segment(img, offset)
+		if err != nil {
+			return image, err
+		}
+		offset += size + 2
+		if section == 0xda {
+			image.Scans = append(image.Scans, Scan{SOS: data})
+			break
+		}
+		if err := check_segment(section, data); err != nil {
+			return image, err
+		}
+		image.Segments = append(image.Segments, Segment{section, data})
+	}
+
+	// A baseline JPEG has one scan; a progressive one has several, with
+	// more tables between them.  The last scan is followed by the EOI
+	// marker, and anything after that is trailing data which we keep so
+	// it can be written back.
+	for {
+		end := scan_end(img, offset)
+		if end == -1 {
+			return image, errors.New("Image is not a JPEG - bad footer: no end of image marker (0xff 0xd9) after the image data at offset " + strconv.Itoa(offset))
+		}
+		image.Scans[len(image.Scans)-1].Data = img[offset:end]
+		offset = end
+		if img[offset+1] == 0xd9 {
+			image.Trailer = img[offset+2:]
+			return image, nil
+		}
+
+		var between []Segment
+		for {
+			section, size, data, err := read_segment(img, offset)
+			if err != nil {
+				return image, err
+			}
+			offset += size + 2
+			if section == 0xda {
+				image.Scans = append(image.Scans, Scan{between, data, nil})
+				break
+			}
+			if err := check_segment(section, data); err != nil {
+				return image, err
+			}
+			between = append(between, Segment{section, data})
+		}
+	}
+}
+
+// Keeps the first error from a series of writes
+type error_writer struct {
+	w   io.Writer
+	err error
+}
+
+func (e *error_writer) Write(p []byte) (int, error) {
+	if e.err != nil {
+		return 0, e.err
+	}
+	n, err := e.w.Write(p)
+	e.err = err
+	return n, err
+}
+
+// Put the JPEG back together
+func Write(f io.Writer, image JPEG) error {
+	w := &error_writer{w: f}
+	w.Write([]byte{0xff, 0xd8})
+	for _, s := range image.Segments {
+		write_segment(w, s.Marker, s.Data)
+	}
+	for _, scan := range image.Scans {
+		for _, s := range scan.Segments {
+			write_segment(w, s.Marker, s.Data)
+		}
+		write_segment(w, 0xda, scan.SOS)
+		w.Write(scan.Data)
+	}
+	w.Write([]byte{0xff, 0xd9})
+	w.Write(image.Trailer)
+	return w.err
+}
+
+// The whole file, as Write would give it
+func Bytes(image JPEG) []byte {
+	var buf bytes.Buffer
+	Write(&buf, image)
+	return buf.Bytes()
+}
+
+// Find the first comment starting with prefix
+func GetComment(image JPEG, prefix string) ([]byte, bool) {
+	for _, s := range image.Segments {
+		if s.Marker == COM && bytes.HasPrefix(s.Data, []byte(prefix)) {
+			return s.Data, true
+		}
+	}
+	return nil, false
+}
+
+// Remove every comment, whoever wrote it
+func StripComments(image *JPEG) {
+	var res []Segment
+	for _, s := range image.Segments {
+		if s.Marker != COM {
+			res = append(res, s)
+		}
+	}
+	image.Segments = res
+}
+
+// Replace any comments starting with prefix with this one (or just
+// remove them, if data is nil).  Other comments are left alone.  JFIF
+// and EXIF want their APPn segments first, so a new comment goes after
+// those.
+func SetComment(image *JPEG, prefix string, data []byte) {
+	var res []Segment
+	added := data == nil
+	for _, s := range image.Segments {
+		if s.Marker == COM && bytes.HasPrefix(s.Data, []byte(prefix)) {
+			continue
+		}
+		if !added && (s.Marker < 0xe0 || s.Marker > 0xef) {
+			res = append(res, Segment{COM, data})
+			added = true
+		}
+		res = append(res, s)
+	}
+	if !added {
+		res = append(res, Segment{COM, data})
+	}
+	image.Segments = res
+}
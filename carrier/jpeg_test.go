@@ -0,0 +1,305 @@
+package carrier
+
+import (
+	"bytes"
+	"image/jpeg"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func fixture(t testing.TB, name string) []byte {
+	t.Helper()
+	data, err := ioutil.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return data
+}
+
+// Parse a file and check writing it back gives the same bytes
+func round_trip(t *testing.T, data []byte) JPEG {
+	t.Helper()
+	image, err := Parse(data)
+	if err != nil {
+		t.Fatalf("Parse: %v", err)
+	}
+	if out := Bytes(image); !bytes.Equal(out, data) {
+		t.Fatalf("Write gave %d bytes that differ from the %d read", len(out), len(data))
+	}
+	return image
+}
+
+// Add a comment as locking does, and check the result still decodes,
+// has the comment, and is the original again once it's removed
+func check_comment(t *testing.T, data []byte) JPEG {
+	t.Helper()
+	image := round_trip(t, data)
+	SetComment(&image, "LOCKPSW:", []byte("LOCKPSW:test"))
+	out := Bytes(image)
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("image with a comment added doesn't decode: %v", err)
+	}
+
+	again := round_trip(t, out)
+	if c, ok := GetComment(again, "LOCKPSW:"); !ok || string(c) != "LOCKPSW:test" {
+		t.Fatalf("GetComment = %q, %v", c, ok)
+	}
+	SetComment(&again, "LOCKPSW:", nil)
+	if !bytes.Equal(Bytes(again), data) {
+		t.Fatal("removing the comment didn't give back the original file")
+	}
+	return image
+}
+
+func markers(segments []Segment) []int {
+	var res []int
+	for _, s := range segments {
+		res = append(res, s.Marker)
+	}
+	return res
+}
+
+func TestBaseline(t *testing.T) {
+	check_comment(t, fixture(t, "baseline.jpg"))
+}
+
+// EXIF, ICC profiles and other people's comments are kept as they were,
+// in order, and ours goes after the APPn segments
+func TestAPPnKept(t *testing.T) {
+	data := fixture(t, "exif.jpg")
+	orig := round_trip(t, data)
+	image := check_comment(t, data)
+
+	want := []int{0xe0, 0xe1, 0xe2, COM, COM}
+	got := markers(image.Segments)
+	if len(got) < len(want) {
+		t.Fatalf("segments %x, want them to start %x", got, want)
+	}
+	for i := range want {
+		if got[i] != want[i] {
+			t.Fatalf("segments %x, want them to start %x", got, want)
+		}
+	}
+	if !bytes.HasPrefix(image.Segments[1].Data, []byte("Exif\x00\x00")) || !bytes.Equal(image.Segments[1].Data, orig.Segments[1].Data) {
+		t.Error("EXIF segment changed")
+	}
+	if !bytes.Equal(image.Segments[2].Data, orig.Segments[2].Data) {
+		t.Error("ICC profile segment changed")
+	}
+	if string(image.Segments[4].Data) != "Copyright someone else" {
+		t.Errorf("other comment is now %q", image.Segments[4].Data)
+	}
+}
+
+// Every scan is found, with the tables between them kept in their place
+func TestProgressive(t *testing.T) {
+	image := check_comment(t, fixture(t, "progressive.jpg"))
+	if len(image.Scans) != 10 {
+		t.Fatalf("found %d scans, want 10", len(image.Scans))
+	}
+	between := 0
+	for i, scan := range image.Scans {
+		if len(scan.SOS) == 0 || len(scan.Data) == 0 {
+			t.Errorf("scan %d is empty", i)
+		}
+		between += len(scan.Segments)
+	}
+	if between == 0 {
+		t.Error("no tables found between the scans")
+	}
+	for _, s := range image.Segments {
+		if s.Marker == 0xc2 {
+			return
+		}
+	}
+	t.Error("no SOF2 segment before the first scan")
+}
+
+// The DRI segment is kept, and the restart markers stay in the scan data
+func TestRestartMarkers(t *testing.T) {
+	image := check_comment(t, fixture(t, "restart.jpg"))
+	dri := -1
+	for i, s := range image.Segments {
+		if s.Marker == 0xdd {
+			dri = i
+		}
+	}
+	if dri == -1 {
+		t.Fatal("no DRI segment found")
+	}
+	if len(image.Scans) != 1 {
+		t.Fatalf("found %d scans, want 1", len(image.Scans))
+	}
+	rst := 0
+	data := image.Scans[0].Data
+	for i := 0; i+1 < len(data); i++ {
+		if data[i] == 0xff && data[i+1] >= 0xd0 && data[i+1] <= 0xd7 {
+			rst++
+		}
+	}
+	if rst == 0 {
+		t.Error("no restart markers in the scan data")
+	}
+
+	image.Segments[dri].Data = []byte{0, 1, 2}
+	if _, err := Parse(Bytes(image)); err == nil || !strings.Contains(err.Error(), "DRI segment is 3 bytes") {
+		t.Errorf("Parse of a 3 byte DRI = %v", err)
+	}
+}
+
+// Both quantisation tables in one DQT and all four Huffman tables in one
+// DHT, which must be kept together as they were
+func TestMultiTableSegments(t *testing.T) {
+	data := fixture(t, "multi-table.jpg")
+	image := round_trip(t, data)
+	check_comment(t, data)
+
+	want := []int{0xe0, 0xdb, 0xc0, 0xc4}
+	if got := markers(image.Segments); !reflect.DeepEqual(got, want) {
+		t.Fatalf("segments %x, want %x", got, want)
+	}
+	if n := len(image.Segments[1].Data); n != 2*65 {
+		t.Errorf("DQT segment is %d bytes, want two 65 byte tables", n)
+	}
+	if n := len(image.Segments[3].Data); n != 2*(29+179) {
+		t.Errorf("DHT segment is %d bytes, want all four tables", n)
+	}
+}
+
+// Twelve DQT and twenty four DHT segments, more than the old limit of ten
+func TestManyTables(t *testing.T) {
+	data := fixture(t, "many-tables.jpg")
+	image := round_trip(t, data)
+	check_comment(t, data)
+
+	count := map[int]int{}
+	for _, s := range image.Segments {
+		count[s.Marker]++
+	}
+	if count[0xdb] != 12 || count[0xc4] != 24 {
+		t.Errorf("found %d DQT and %d DHT segments, want 12 and 24", count[0xdb], count[0xc4])
+	}
+}
+
+// Every comment goes, and nothing else does
+func TestStripComments(t *testing.T) {
+	data := fixture(t, "exif.jpg")
+	orig := round_trip(t, data)
+	image := round_trip(t, data)
+	StripComments(&image)
+
+	want := []int{0xe0, 0xe1, 0xe2}
+	if got := markers(image.Segments); !reflect.DeepEqual(got[:3], want) || len(got) != len(orig.Segments)-1 {
+		t.Fatalf("segments %x, want %x without the comment", got, markers(orig.Segments))
+	}
+	for _, s := range image.Segments {
+		if s.Marker == COM {
+			t.Fatal("a comment is left")
+		}
+	}
+	out := Bytes(image)
+	if _, err := jpeg.Decode(bytes.NewReader(out)); err != nil {
+		t.Fatalf("image without its comments doesn't decode: %v", err)
+	}
+	SetComment(&image, "LOCKPSW:", []byte("LOCKPSW:test"))
+	if c, ok := GetComment(round_trip(t, Bytes(image)), "LOCKPSW:"); !ok || string(c) != "LOCKPSW:test" {
+		t.Fatalf("GetComment = %q, %v", c, ok)
+	}
+}
+
+func TestBadHeader(t *testing.T) {
+	good := fixture(t, "baseline.jpg")
+	with := func(b0, b1 byte) []byte {
+		return append([]byte{b0, b1}, good[2:]...)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"empty", nil, "ends at offset 0"},
+		{"one byte", []byte{0xff}, "ends at offset 1"},
+		{"first byte wrong", with(0xfe, 0xd8), "at offset 0, found 0xfe 0xd8"},
+		{"second byte wrong", with(0xff, 0xd9), "at offset 0, found 0xff 0xd9"},
+		{"PNG", []byte("\x89PNG\r\n\x1a\n"), "at offset 0, found 0x89 0x50"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+func TestBadSegments(t *testing.T) {
+	soi := []byte{0xff, 0xd8}
+	tests := []struct {
+		name string
+		data []byte
+		want string
+	}{
+		{"past the end", append(soi, 0xff, 0xe0, 0x00, 0x10, 'J', 'F'), "segment 0xe0 at offset 2 is 16 bytes, which runs past the end of the file at 8"},
+		{"too small", append(soi, 0xff, 0xfe, 0x00, 0x01, 0, 0), "segment 0xfe at offset 2 has a size of 1"},
+		{"no marker", append(soi, 0x12, 0xe0, 0x00, 0x02), "expected 0xff at offset 2, found 0x12"},
+		{"header cut short", append(soi, 0xff, 0xe0, 0x00), "file ends at offset 5 in the middle of a segment header at 2"},
+		{"no EOI", append(soi, 0xff, 0xda, 0x00, 0x02, 1, 2, 3), "no end of image marker (0xff 0xd9) after the image data at offset 6"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := Parse(tt.data)
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("Parse = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// Cutting a file short anywhere gives an error saying where, not a panic
+func TestTruncated(t *testing.T) {
+	for _, name := range []string{"baseline.jpg", "exif.jpg"} {
+		data := fixture(t, name)
+		for n := 0; n < len(data); n++ {
+			_, err := Parse(data[:n])
+			if err == nil {
+				t.Fatalf("%s cut to %d bytes: Parse succeeded", name, n)
+			}
+			if !strings.Contains(err.Error(), "offset") {
+				t.Fatalf("%s cut to %d bytes: error %q doesn't give an offset", name, n, err)
+			}
+		}
+	}
+}
+
+// Whatever Parse accepts, it writes back unchanged and reads the same
+// again; anything else is an error, never a panic
+func FuzzParseJPEG(f *testing.F) {
+	for _, name := range []string{"baseline.jpg", "progressive.jpg", "exif.jpg"} {
+		data := fixture(f, name)
+		f.Add(data)
+		f.Add(data[:len(data)/2])
+		f.Add(data[:len(data)-1])
+	}
+	f.Add([]byte{0xff, 0xd8, 0xff, 0xd9})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		image, err := Parse(data)
+		if err != nil {
+			return
+		}
+		out := Bytes(image)
+		if !bytes.Equal(out, data) {
+			t.Fatalf("Write gave %d bytes that differ from the %d read", len(out), len(data))
+		}
+		again, err := Parse(out)
+		if err != nil {
+			t.Fatalf("can't parse what Write gave: %v", err)
+		}
+		if !reflect.DeepEqual(again, image) {
+			t.Fatal("parsing the written file gave a different result")
+		}
+	})
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"sort"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Shell completion
+//
+// -completion bash|zsh|fish prints a script to source.  It's made from
+// the flags as defined, so it can't get out of step with them; lock
+// images are completed as file names.
+//
+//////////////////////////////////////////////////////////////////////
+
+// Flags whose value is a file name
+var completion_files = map[string]bool{
+	"cacert":        true,
+	"config":        true,
+	"diff":          true,
+	"keyfile":       true,
+	"lock-dir":      true,
+	"logfile":       true,
+	"save-response": true,
+	"snapshot":      true,
+	"source":        true,
+}
+
+// Flags with a fixed set of values
+var completion_choices = map[string][]string{
+	"auth":          {"basic", "digest", "bearer"},
+	"charset":       {"alnum", "no-ambiguous", "full"},
+	"checksum-algo": {"crc32", "sha256", "blake2b", "none"},
+	"completion":    {"bash", "zsh", "fish"},
+	"scheme":        {"http", "https"},
+	"search-order":  {"comment,trailer,xmp", "trailer,comment,xmp", "xmp,comment,trailer"},
+}
+
+type completion_flag struct {
+	name    string
+	usage   string
+	is_bool bool
+}
+
+func completion_flags() []completion_flag {
+	var res []completion_flag
+	flag.VisitAll(func(f *flag.Flag) {
+		b, ok := f.Value.(interface{ IsBoolFlag() bool })
+		res = append(res, completion_flag{f.Name, f.Usage, ok && b.IsBoolFlag()})
+	})
+	sort.Slice(res, func(i, j int) bool { return res[i].name < res[j].name })
+	return res
+}
+
+func completion_script(shell string) (string, error) {
+	switch shell {
+	case "bash":
+		return bash_completion(), nil
+	case "zsh":
+		return zsh_completion(), nil
+	case "fish":
+		return fish_completion(), nil
+	}
+	return "", errors.New("Unknown shell " + shell + " for -completion; use bash, zsh or fish")
+}
+
+func bash_completion() string {
+	var names, files, values []string
+	choices := ""
+	for _, f := range completion_flags() {
+		names = append(names, "-"+f.name)
+		if completion_files[f.name] {
+			files = append(files, "-"+f.name)
+		} else if c, ok := completion_choices[f.name]; ok {
+			choices += "\t\t-" + f.name + ") COMPREPLY=($(compgen -W \"" + strings.Join(c, " ") + "\" -- \"$cur\")); return ;;\n"
+		} else if !f.is_bool {
+			values = append(values, "-"+f.name)
+		}
+	}
+
+	return "# picture_lock completion for bash; use with\n" +
+		"#   source <(picture_lock -completion bash)\n" +
+		"_picture_lock() {\n" +
+		"\tlocal cur=\"${COMP_WORDS[COMP_CWORD]}\"\n" +
+		"\tlocal prev=\"${COMP_WORDS[COMP_CWORD-1]}\"\n" +
+		"\tcase \"$prev\" in\n" +
+		"\t\t" + strings.Join(files, "|") + ") COMPREPLY=($(compgen -f -- \"$cur\")); return ;;\n" +
+		choices +
+		"\t\t" + strings.Join(values, "|") + ") return ;;\n" +
+		"\tesac\n" +
+		"\tif [[ \"$cur\" == -* ]]; then\n" +
+		"\t\tCOMPREPLY=($(compgen -W \"" + strings.Join(names, " ") + "\" -- \"$cur\"))\n" +
+		"\telse\n" +
+		"\t\tCOMPREPLY=($(compgen -f -- \"$cur\"))\n" +
+		"\tfi\n" +
+		"}\n" +
+		"complete -o filenames -F _picture_lock picture_lock\n"
+}
+
+// Usage text that's safe inside a zsh _arguments spec or a fish string
+func completion_text(str string) string {
+	return strings.NewReplacer("'", "", "[", "(", "]", ")", ":", " ", "\\", "").Replace(str)
+}
+
+func zsh_completion() string {
+	res := "#compdef picture_lock\n" +
+		"# picture_lock completion for zsh; use with\n" +
+		"#   source <(picture_lock -completion zsh)\n" +
+		"_picture_lock() {\n" +
+		"\t_arguments \\\n"
+	for _, f := range completion_flags() {
+		spec := "-" + f.name + "[" + completion_text(f.usage) + "]"
+		if completion_files[f.name] {
+			spec += ":file:_files"
+		} else if c, ok := completion_choices[f.name]; ok {
+			spec += ":value:(" + strings.Join(c, " ") + ")"
+		} else if !f.is_bool {
+			spec += ":value: "
+		}
+		res += "\t\t'" + spec + "' \\\n"
+	}
+	return res + "\t\t'*:lock image:_files'\n" +
+		"}\n" +
+		"compdef _picture_lock picture_lock\n"
+}
+
+func fish_completion() string {
+	res := "# picture_lock completion for fish; use with\n" +
+		"#   picture_lock -completion fish | source\n"
+	for _, f := range completion_flags() {
+		line := "complete -c picture_lock -o " + f.name + " -d '" + completion_text(f.usage) + "'"
+		if completion_files[f.name] {
+			line += " -r -F"
+		} else if c, ok := completion_choices[f.name]; ok {
+			line += " -x -a '" + strings.Join(c, " ") + "'"
+		} else if !f.is_bool {
+			line += " -x"
+		}
+		res += line + "\n"
+	}
+	return res
+}
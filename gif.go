@@ -0,0 +1,207 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"image/gif"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// GIF lock images
+//
+// A GIF is a header (signature, screen descriptor and maybe a colour
+// table) followed by blocks: extensions, which start 0x21 and a label,
+// and images, which start 0x2c.  Both end in a run of sub-blocks, each
+// a length byte and up to 255 bytes of data, finished by a zero length.
+// 0x3b ends the file.  We keep every block as-is, so all the frames of
+// an animation are untouched, and store the payload in a comment
+// extension (label 0xfe).
+//
+//////////////////////////////////////////////////////////////////////
+
+const gif_comment_label = 0xfe
+
+type GIF_Block struct {
+	label byte   // extension label, or 0x2c for an image
+	data  []byte // the whole block, as it was in the file
+}
+
+type GIF struct {
+	header  []byte
+	blocks  []GIF_Block
+	trailer []byte // anything after the end of the GIF
+}
+
+func is_gif(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("GIF87a")) || bytes.HasPrefix(data, []byte("GIF89a"))
+}
+
+// Skip over a run of sub-blocks, returning the offset after its end
+func gif_sub_blocks(img []byte, offset int) (int, error) {
+	for {
+		if offset >= len(img) {
+			return 0, errors.New("Bad GIF - truncated data at " + strconv.Itoa(offset))
+		}
+		size := int(img[offset])
+		offset++
+		if size == 0 {
+			return offset, nil
+		}
+		offset += size
+	}
+}
+
+// Size of the colour table described by a flags byte, if it has one
+func gif_colour_table(flags byte) int {
+	if flags&0x80 == 0 {
+		return 0
+	}
+	return 3 << ((flags & 7) + 1)
+}
+
+func parse_gif(img []byte) (GIF, error) {
+	var image GIF
+	if !is_gif(img) || len(img) < 13 {
+		return image, errors.New("Not a GIF file")
+	}
+
+	offset := 13 + gif_colour_table(img[10])
+	if offset > len(img) {
+		return image, errors.New("Bad GIF - truncated colour table")
+	}
+	image.header = img[:offset]
+
+	for {
+		if offset >= len(img) {
+			return image, errors.New("Bad GIF - no trailer")
+		}
+		start := offset
+		var label byte
+		var err error
+		switch img[offset] {
+		case 0x3b:
+			image.trailer = img[offset+1:]
+			return image, nil
+		case 0x21:
+			if offset+2 > len(img) {
+				return image, errors.New("Bad GIF - truncated extension at " + strconv.Itoa(offset))
+			}
+			label = img[offset+1]
+			offset, err = gif_sub_blocks(img, offset+2)
+		case 0x2c:
+			// Image descriptor, maybe a colour table, then the LZW
+			// code size before the image data
+			if offset+10 > len(img) {
+				return image, errors.New("Bad GIF - truncated image at " + strconv.Itoa(offset))
+			}
+			label = 0x2c
+			offset, err = gif_sub_blocks(img, offset+10+gif_colour_table(img[offset+9])+1)
+		default:
+			return image, errors.New("Bad GIF - unknown block " + strconv.Itoa(int(img[offset])) + " at " + strconv.Itoa(offset))
+		}
+		if err != nil {
+			return image, err
+		}
+		image.blocks = append(image.blocks, GIF_Block{label, img[start:offset]})
+	}
+}
+
+func write_gif(f io.Writer, image GIF) error {
+	_, err := f.Write(image.header)
+	for _, b := range image.blocks {
+		if err == nil {
+			_, err = f.Write(b.data)
+		}
+	}
+	if err == nil {
+		_, err = f.Write([]byte{0x3b})
+	}
+	if err == nil {
+		_, err = f.Write(image.trailer)
+	}
+	return err
+}
+
+// The text of a comment block, with the sub-blocks joined back up
+func gif_comment_text(block GIF_Block) []byte {
+	var res []byte
+	for offset := 2; offset < len(block.data) && block.data[offset] != 0; {
+		size := int(block.data[offset])
+		res = append(res, block.data[offset+1:offset+1+size]...)
+		offset += size + 1
+	}
+	return res
+}
+
+// Find the comment holding our payload
+func gif_comment(image GIF) ([]byte, bool) {
+	for _, b := range image.blocks {
+		if b.label != gif_comment_label {
+			continue
+		}
+		if text := gif_comment_text(b); is_payload(text) {
+			return text, true
+		}
+	}
+	return nil, false
+}
+
+// Replace any old payload with a new one, at the end of the file so it
+// doesn't get in the way of the animation settings
+func embed_gif_password(image *GIF, payload []byte) {
+	block := []byte{0x21, gif_comment_label}
+	for rest := payload; len(rest) > 0; {
+		n := len(rest)
+		if n > 255 {
+			n = 255
+		}
+		block = append(block, byte(n))
+		block = append(block, rest[:n]...)
+		rest = rest[n:]
+	}
+	block = append(block, 0)
+
+	var blocks []GIF_Block
+	for _, b := range image.blocks {
+		if b.label == gif_comment_label && is_payload(gif_comment_text(b)) {
+			continue
+		}
+		blocks = append(blocks, b)
+	}
+	image.blocks = append(blocks, GIF_Block{gif_comment_label, block})
+
+	// Extensions only arrived with GIF89a
+	image.header = append([]byte("GIF89a"), image.header[6:]...)
+}
+
+// Find the password in a GIF's comment
+func extract_gif_password(image GIF) (LockInfo, error) {
+	payload, ok := gif_comment(image)
+	if !ok {
+		return LockInfo{}, no_payload
+	}
+	_, info, err := decode_payload(payload)
+	return info, err
+}
+
+// Make sure an animation still has all its frames once the password
+// has been added
+func check_gif_frames(src []byte, image GIF) error {
+	orig, err := gif.DecodeAll(bytes.NewReader(src))
+	if err != nil {
+		return errors.New("Could not decode the source GIF: " + err.Error())
+	}
+	var buf bytes.Buffer
+	write_gif(&buf, image)
+	res, err := gif.DecodeAll(&buf)
+	if err != nil {
+		return errors.New("Could not decode the GIF after adding the password: " + err.Error())
+	}
+	if len(res.Image) != len(orig.Image) {
+		return errors.New("The GIF has " + strconv.Itoa(len(res.Image)) + " frames after adding the password, but had " + strconv.Itoa(len(orig.Image)))
+	}
+	return nil
+}
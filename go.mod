@@ -3,7 +3,10 @@ module picture_lock
 go 1.17
 
 require (
-	github.com/ghodss/yaml v1.0.0 // indirect
-	github.com/tkanos/gonfig v0.0.0-20210106201359-53e13348de2f // indirect
-	gopkg.in/yaml.v2 v2.4.0 // indirect
+	github.com/ghodss/yaml v1.0.0
+	golang.org/x/crypto v0.5.0
+	golang.org/x/sys v0.4.0
+	golang.org/x/term v0.4.0
 )
+
+require gopkg.in/yaml.v2 v2.4.0 // indirect
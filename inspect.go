@@ -0,0 +1,149 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"picture_lock/carrier"
+	"strconv"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Looking inside a JPEG
+//
+// -inspect lists a JPEG's segments as they are in the file, with where
+// each starts and how long it is, and says which ones hold one of our
+// payloads.  It's read only and never talks to the safe, and it never
+// shows the password; -test-all-stores does that, masked.
+//
+//////////////////////////////////////////////////////////////////////
+
+func marker_name(m int) string {
+	switch {
+	case m == 0xc4:
+		return "DHT"
+	case m == 0xc8:
+		return "JPG"
+	case m == 0xcc:
+		return "DAC"
+	case m >= 0xc0 && m <= 0xcf:
+		return "SOF" + strconv.Itoa(m-0xc0)
+	case m == 0xd8:
+		return "SOI"
+	case m == 0xd9:
+		return "EOI"
+	case m == 0xda:
+		return "SOS"
+	case m == 0xdb:
+		return "DQT"
+	case m == 0xdd:
+		return "DRI"
+	case m >= 0xe0 && m <= 0xef:
+		return "APP" + strconv.Itoa(m-0xe0)
+	case m == 0xfe:
+		return "COM"
+	}
+	return "?"
+}
+
+// What a payload is, without what's in it
+func describe_payload(payload []byte) string {
+	_, info, err := decode_payload(payload)
+	if err != nil {
+		return "damaged payload (" + err.Error() + ")"
+	}
+	if info.Share != "" {
+		return "payload with " + describe_share(info)
+	}
+	return "password payload"
+}
+
+// The well known kinds of APPn segment, from the name they start with
+func segment_notes(s carrier.Segment) string {
+	if s.Marker == carrier.COM {
+		if is_payload(s.Data) {
+			return describe_payload(s.Data)
+		}
+		return "comment"
+	}
+	if s.Marker == xmp_marker && bytes.HasPrefix(s.Data, []byte(xmp_header)) {
+		if payload, ok := xmp_payload(carrier.JPEG{Segments: []carrier.Segment{s}}); ok {
+			return "XMP, with a " + describe_payload(payload)
+		}
+		return "XMP"
+	}
+	names := []struct {
+		marker int
+		prefix string
+		note   string
+	}{
+		{0xe0, "JFIF\x00", "JFIF"},
+		{0xe0, "JFXX\x00", "JFIF thumbnail"},
+		{0xe1, "Exif\x00", "EXIF"},
+		{0xe2, "ICC_PROFILE\x00", "ICC colour profile"},
+		{0xed, "Photoshop", "Photoshop"},
+		{0xee, "Adobe", "Adobe"},
+	}
+	for _, n := range names {
+		if s.Marker == n.marker && bytes.HasPrefix(s.Data, []byte(n.prefix)) {
+			return n.note
+		}
+	}
+	return ""
+}
+
+func inspect_image(file string) error {
+	data, err := read_file(file)
+	if err != nil {
+		return err
+	}
+	if !(len(data) >= 2 && data[0] == 0xff && data[1] == 0xd8) {
+		return errors.New("-inspect only lists JPEG segments; use -test-all-stores to check other images")
+	}
+	image, err := carrier.Parse(data)
+	if err != nil {
+		return err
+	}
+
+	// carrier.Parse keeps everything, so the offsets can be worked out
+	// from what it found
+	fmt.Printf("%-8s  %-6s  %-5s  %-6s  %s\n", "Offset", "Marker", "Name", "Length", "Notes")
+	offset := 0
+	row := func(marker int, length int, notes string) {
+		m, name := "", ""
+		if marker != 0 {
+			m, name = fmt.Sprintf("0xff%02x", marker), marker_name(marker)
+		}
+		fmt.Println(strings.TrimRight(fmt.Sprintf("%-8d  %-6s  %-5s  %-6d  %s", offset, m, name, length, notes), " "))
+	}
+	segment := func(s carrier.Segment) {
+		row(s.Marker, len(s.Data)+2, segment_notes(s))
+		offset += len(s.Data) + 4
+	}
+
+	row(0xd8, 0, "")
+	offset += 2
+	for _, s := range image.Segments {
+		segment(s)
+	}
+	for _, scan := range image.Scans {
+		for _, s := range scan.Segments {
+			segment(s)
+		}
+		segment(carrier.Segment{Marker: 0xda, Data: scan.SOS})
+		row(0, len(scan.Data), "image data")
+		offset += len(scan.Data)
+	}
+	row(0xd9, 0, "")
+	offset += 2
+	if len(image.Trailer) > 0 {
+		notes := "after the end of the image"
+		if payload, _, ok := find_trailer(image.Trailer); ok {
+			notes += ", with a " + describe_payload(payload)
+		}
+		row(0, len(image.Trailer), notes)
+	}
+	return nil
+}
@@ -0,0 +1,60 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Operation log
+//
+// With -logfile every lock, unlock and test is recorded as a line of
+// JSON appended to the file: when, what, which safe and images, and
+// whether it worked.  Each line is written with the file opened for
+// append and then closed, so logrotate and the like can move the file
+// away at any time.  Like everything else that could be shared, it
+// goes through redact(), so passwords never reach it.
+//
+//////////////////////////////////////////////////////////////////////
+
+var logfile string
+
+type LogEntry struct {
+	Time      string
+	Operation string
+	Safe      string
+	Images    []string
+	OK        bool
+	Error     string `json:",omitempty"`
+}
+
+// Record an operation; a log we can't write is only a warning, as
+// whatever it was has already happened
+func log_operation(operation string, images []string, err error) {
+	if logfile == "" {
+		return
+	}
+
+	// Each string is cleaned before it's encoded, as JSON escaping could
+	// hide a password from redact()
+	entry := LogEntry{
+		Time:      time.Now().UTC().Format(time.RFC3339),
+		Operation: operation,
+		Safe:      redact(safe),
+		OK:        err == nil,
+	}
+	for _, i := range images {
+		entry.Images = append(entry.Images, redact(i))
+	}
+	if err != nil {
+		entry.Error = redact(err.Error())
+	}
+
+	line, _ := json.Marshal(entry)
+	if err := write_state_file(logfile, append(line, '\n'), true); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not write to the log file "+logfile+": "+err.Error())
+	}
+}
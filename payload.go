@@ -0,0 +1,253 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"golang.org/x/crypto/blake2b"
+	"hash/crc32"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// The password payload
+//
+// Every place we hide a password (comment, trailer, pixels...) stores
+// the same payload, and all of them go through encode_payload and
+// decode_payload so the framing can't drift between them.
+//
+// The original format was just
+//   LOCKPSW:password
+// Since a password can never contain a : we can tell that apart from
+//   LOCKPSW:version:data
+// where version 2 data is a LockInfo as JSON.
+//
+// With -shares an image holds one share of the password rather than the
+// password itself.  That uses its own prefix, so older versions of this
+// program don't mistake it for a password:
+//   LOCKSHR:2:data
+//
+//////////////////////////////////////////////////////////////////////
+
+const payload_prefix = "LOCKPSW:"
+const share_prefix = "LOCKSHR:"
+
+// Whether some data is one of our payloads, of either sort
+func is_payload(data []byte) bool {
+	str := string(data)
+	return strings.HasPrefix(str, payload_prefix) || strings.HasPrefix(str, share_prefix)
+}
+
+// What's stored alongside the password
+type LockInfo struct {
+	Password string
+	Created  string `json:",omitempty"`
+	// The safe it was locked on
+	Safe     string `json:",omitempty"`
+	Checksum string `json:",omitempty"`
+	HMAC     string `json:",omitempty"`
+	// Seconds the safe was asked to stay locked, with -duration
+	Duration int64 `json:",omitempty"`
+
+	// Instead of the password, share number ShareX of Shares (in hex).
+	// Threshold of the images from the same ShareSet rebuild it.  The
+	// Checksum is of the share itself: one of the whole password would
+	// let anyone with a single share try passwords against it.
+	Share     string `json:",omitempty"`
+	ShareX    int    `json:",omitempty"`
+	Shares    int    `json:",omitempty"`
+	Threshold int    `json:",omitempty"`
+	ShareSet  string `json:",omitempty"`
+}
+
+// Choices made when building a payload
+type PayloadOptions struct {
+	Safe     string
+	Checksum string
+	SignKey  string
+	Duration time.Duration
+}
+
+// Returned when there's simply no payload, as opposed to a damaged one
+var no_payload = errors.New("This is not a valid password image")
+
+// Sending an empty password to the safe would never be right
+var empty_password = errors.New("Damaged payload: the password is empty")
+
+// Passwords we make are printable ASCII, without a : (see
+// resolve_charset).  Anything else came from a damaged payload, or one
+// we didn't write, and shouldn't be sent to the safe.
+func check_password(psw string) error {
+	if psw == "" {
+		return empty_password
+	}
+	for i := 0; i < len(psw); i++ {
+		if c := psw[i]; c <= 0x20 || c > 0x7e || c == ':' {
+			return errors.New("Damaged payload: the password has a byte (" + strconv.Itoa(int(c)) + ", at " + strconv.Itoa(i) + ") that passwords never have")
+		}
+	}
+	return nil
+}
+
+// The checksum of the password is stored as algorithm:hex so we know how
+// to check it again later
+var checksum_algo string
+
+func make_checksum(algo string, data string) (string, error) {
+	var sum []byte
+	switch algo {
+	case "crc32":
+		var b [4]byte
+		binary.BigEndian.PutUint32(b[:], crc32.ChecksumIEEE([]byte(data)))
+		sum = b[:]
+	case "sha256":
+		b := sha256.Sum256([]byte(data))
+		sum = b[:]
+	case "blake2b":
+		b := blake2b.Sum256([]byte(data))
+		sum = b[:]
+	default:
+		return "", errors.New("Unknown checksum algorithm " + algo + "; use crc32, sha256, blake2b or none")
+	}
+	return algo + ":" + hex.EncodeToString(sum), nil
+}
+
+// Images from before checksums were added are fine; otherwise the stored
+// checksum has to match
+func check_checksum(info LockInfo) error {
+	if info.Checksum == "" {
+		return nil
+	}
+	algo := strings.SplitN(info.Checksum, ":", 2)[0]
+	sum, err := make_checksum(algo, info.Password)
+	if err != nil {
+		return err
+	}
+	if sum != info.Checksum {
+		return errors.New("Embedded password does not match its " + algo + " checksum; the image may be damaged")
+	}
+	return nil
+}
+
+// Secret used to sign payloads so tampering can be detected
+var sign_key string
+
+// HMAC-SHA256 over the whole payload (less the HMAC itself).  The key is
+// derived from the user's secret rather than used directly.
+func sign_payload(info LockInfo, secret string) string {
+	key := sha256.Sum256([]byte("picture_lock sign:" + secret))
+	info.HMAC = ""
+	data, _ := json.Marshal(info)
+	mac := hmac.New(sha256.New, key[:])
+	mac.Write(data)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// If we've been given a key then the payload must be signed with it; if
+// not, a signed payload can't be trusted because we can't check it
+func check_signature(info LockInfo, secret string) error {
+	if secret == "" {
+		if info.HMAC != "" {
+			return errors.New("This image is signed; use -sign with the secret to check it")
+		}
+		return nil
+	}
+	if info.HMAC == "" {
+		return errors.New("This image is not signed, but -sign was given")
+	}
+	if !hmac.Equal([]byte(info.HMAC), []byte(sign_payload(info, secret))) {
+		return errors.New("This image's signature does not match; it may have been tampered with")
+	}
+	return nil
+}
+
+// The options from the command line
+func payload_options() PayloadOptions {
+	opts := PayloadOptions{Safe: safe, SignKey: sign_key, Duration: lock_duration}
+	if checksum_algo != "none" {
+		opts.Checksum = checksum_algo
+	}
+	return opts
+}
+
+func encode_payload(psw string, opts PayloadOptions) []byte {
+	info := LockInfo{Password: psw}
+	return encode_info(payload_prefix, psw, info, opts)
+}
+
+// A payload holding one share of the password; the rest of info says
+// which share it is
+func encode_share_payload(info LockInfo, opts PayloadOptions) []byte {
+	info.Password = ""
+	return encode_info(share_prefix, info.Share, info, opts)
+}
+
+// The checksum, if there is one, is of summed: the password, or the share
+func encode_info(prefix string, summed string, info LockInfo, opts PayloadOptions) []byte {
+	info.Created = time.Now().UTC().Format(time.RFC3339)
+	info.Safe = opts.Safe
+	info.Duration = int64(opts.Duration / time.Second)
+	if opts.Checksum != "" {
+		// Already validated in main()
+		info.Checksum, _ = make_checksum(opts.Checksum, summed)
+	}
+	if opts.SignKey != "" {
+		info.HMAC = sign_payload(info, opts.SignKey)
+	}
+	data, _ := json.Marshal(info)
+	return []byte(prefix + "2:" + string(data))
+}
+
+// Returns no_payload if this isn't one of ours at all.  Any other error
+// means the payload is there but can't be trusted; the LockInfo is still
+// filled in as far as possible so it can be reported.
+func decode_payload(data []byte) (string, LockInfo, error) {
+	var info LockInfo
+	str := string(data)
+	share := strings.HasPrefix(str, share_prefix)
+	if !share && !strings.HasPrefix(str, payload_prefix) {
+		return "", info, no_payload
+	}
+	// Both prefixes are the same length
+	str = str[len(payload_prefix):]
+
+	parts := strings.SplitN(str, ":", 2)
+	if len(parts) == 1 && share {
+		return "", info, errors.New("Damaged payload: share has no version")
+	}
+	if len(parts) == 1 {
+		info.Password = str
+		if err := check_password(info.Password); err != nil {
+			return "", info, err
+		}
+		return info.Password, info, nil
+	}
+	if parts[0] != "2" {
+		return "", info, errors.New("Unknown payload version " + parts[0] + "; a newer version of this program may be needed")
+	}
+	if err := json.Unmarshal([]byte(parts[1]), &info); err != nil {
+		return "", info, errors.New("Damaged payload: " + err.Error())
+	}
+	if share {
+		if info.Share == "" || info.Password != "" {
+			return "", info, errors.New("Damaged payload: share has no share data")
+		}
+		if err := check_checksum(LockInfo{Password: info.Share, Checksum: info.Checksum}); err != nil {
+			return "", info, errors.New("Share does not match its checksum; the image may be damaged")
+		}
+		return "", info, nil
+	}
+	if err := check_password(info.Password); err != nil {
+		return "", info, err
+	}
+	if err := check_checksum(info); err != nil {
+		return "", info, err
+	}
+	return info.Password, info, nil
+}
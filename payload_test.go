@@ -0,0 +1,55 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestCheckPassword(t *testing.T) {
+	tests := []struct {
+		name string
+		psw  string
+		want string
+	}{
+		{"valid", "Abc/Def+Ghi%Jkl", ""},
+		{"ends of the allowed range", "!~09azAZ", ""},
+		{"empty", "", empty_password.Error()},
+		{"NUL", "Abc\x00Def", "(0, at 3)"},
+		{"space", "Abc Def", "(32, at 3)"},
+		{"colon", "Abc:Def", "(58, at 3)"},
+		{"DEL", "\x7fAbcDef", "(127, at 0)"},
+		{"high byte", "AbcDef\xe9", "(233, at 6)"},
+		{"UTF-8", "Abcé", "(195, at 3)"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := check_password(tt.psw)
+			if tt.want == "" {
+				if err != nil {
+					t.Errorf("check_password(%q) = %v", tt.psw, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("check_password(%q) = %v, want an error with %q", tt.psw, err, tt.want)
+			}
+		})
+	}
+}
+
+// A binary comment that starts with our prefix mustn't give a password
+// that would be sent to the safe
+func TestDecodePayloadBinary(t *testing.T) {
+	tests := []string{
+		"LOCKPSW:Abc\x00\x00Def",
+		"LOCKPSW:\x00",
+		"LOCKPSW:2:{\"Password\":\"Abc\\u0000Def\"}",
+		"LOCKPSW:\xff\xd8\xff\xe0",
+	}
+	for _, data := range tests {
+		psw, _, err := decode_payload([]byte(data))
+		if err == nil || err == no_payload {
+			t.Errorf("decode_payload(%q) = %q, %v; want a damaged payload error", data, psw, err)
+		}
+	}
+}
@@ -5,16 +5,32 @@
 // This can now be the unlock image.
 //
 // Commands:
-//  ./picture_lock {common} -lock -source source_image.jpg locked_image.jpg
+//  ./picture_lock {common} -lock [-trailer] -source source_image.jpg locked_image.jpg
+//  ./picture_lock {common} -lock [-trailer] -placeholder "640x480 blue" locked_image.jpg
+//  ./picture_lock {common} -lock -quality 80 -source orig_image.jpg locked_image.jpg
+//  ./picture_lock {common} -lock -source source_image.png locked_image.png
+//  ./picture_lock {common} -lock -source source_image.gif locked_image.gif
+//  ./picture_lock {common} -lock -source source_image.webp locked_image.webp
+//  ./picture_lock {common} -lock -count 3 -source source_image.jpg locked_image.jpg
+//  ./picture_lock {common} -lock -shares 3 -threshold 2 -source source_image.jpg locked_image.jpg
+//  ./picture_lock {common} -unlock locked_image-1.jpg locked_image-3.jpg
+//  ./picture_lock {common} -lock -steg -source source_image.jpg locked_image.png
+//  ./picture_lock {common} -lock -source - - < source_image.jpg > locked_image.jpg
 //  ./picture_lock {common} -test locked_image.jpg
 //  ./picture_lock {common} -unlock locked_image.jpg
-//  ./picture_lock {common} -status
+//  ./picture_lock {common} -status [-json] [-snapshot now.json] [-diff baseline.json]
+//  ./picture_lock {common} -serve :8080 -serve-user user -serve-pass pass
+//  ./picture_lock -test-all-stores locked_image.jpg
+//  ./picture_lock -list-profiles
+//  ./picture_lock -gen
 //
 // Common options:
-//  [-user username -pass password] -safe safe.name
+//  [-user username -pass password] [-auth basic|digest|bearer [-token token]]
+//  -safe safe.name [-scheme https]
 //
 // These can also be set in $HOME/.picture_lock (or %HOMEDIR%%HOMEPATH%
-// on windows as a JSON file so they don't need to be passed each time
+// on windows as a JSON (or YAML) file so they don't need to be passed
+// each time.  -config names a different file.
 //
 // e.g.
 // {
@@ -23,370 +39,3176 @@
 // 	"Pass": "password"
 // }
 //
+// Several safes can be described in a "Profiles" object, keyed by
+// name, each holding its own Safe/User/Pass values; -profile picks one.
+//
+// The way URLs are built can be changed with -url-template (or
+// "URLTemplate" in the config file) for firmware that works differently.
+//
 // A safe name is mandatory, username/password are optional but if the
 // safe requires them then you need to specify them
+//
+// By default the password is stored in the JPEG comment segment.  With
+// -trailer it is instead appended after the end-of-image marker, where
+// decoders ignore it and tools that strip comments won't see it.
+//
+// With -steg the password is hidden in the pixels and the lock image saved
+// as PNG.  That survives being re-saved or screenshotted, as long as it's
+// kept in a lossless format at the original size.
+//
+// -verify-image-is-lockable checks the source image can hold and give back
+// a password before the safe is locked.
+//
+// -search-order lists the places -unlock and -test look for the password,
+// first match wins.  -verbose reports which one was used.
+//
+// The lock time and safe are stored with the password; -max-age warns when an image
+// being used to test or unlock is older than expected.  A checksum of the
+// password is stored too (-checksum-algo) and checked when it is read back.
 
 package main
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
-	"github.com/tkanos/gonfig"
+	"github.com/ghodss/yaml"
+	"golang.org/x/term"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/jpeg"
+	"image/png"
 	"io"
 	"io/ioutil"
-	"math/rand"
+	"math"
+	"net"
 	"net/http"
+	"net/url"
 	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"picture_lock/carrier"
+	"regexp"
 	"runtime"
+	"runtime/debug"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 )
 
+// Set when building, with -ldflags "-X main.version=... -X main.commit=...
+// -X main.build_date=..." (see the Makefile)
+var version = "dev"
+var commit = ""
+var build_date = ""
+
+// What -version prints.  Without the ldflags, go build may still have
+// recorded the commit it was built from, and the time of that commit.
+func version_string() string {
+	c, d := commit, build_date
+	if info, ok := debug.ReadBuildInfo(); ok {
+		for _, s := range info.Settings {
+			if s.Key == "vcs.revision" && c == "" {
+				c = s.Value
+			}
+			if s.Key == "vcs.time" && d == "" {
+				d = s.Value
+			}
+		}
+	}
+	if c == "" {
+		c = "unknown"
+	}
+	if d == "" {
+		d = "unknown"
+	}
+	return "picture_lock " + version + " (commit " + c + ", built " + d + ", " + runtime.Version() + ")"
+}
+
 // What characters we allow for safe passwords.  In theory anything except
 // a : should work, but we're gonna be more restrictive
 const pswdstring = "ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz0123456789"
 
+// -charset can name one of these, or list the characters to use
+var charset_presets = map[string]string{
+	"alnum":        pswdstring,
+	"no-ambiguous": "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789",
+	"full":         pswdstring + "!#$%&()*+,-./;<=>?@[]^_{}~",
+}
+
+// The characters passwords are made from, after -charset is resolved
+var charset string
+var charset_flag string
+
+// Turn a preset name or list of characters into the set to use.  A :
+// would break the LOCKPSW:password payload, and anything not printable
+// ASCII may be mangled by the safe or by tools that handle comments.
+func resolve_charset(str string) (string, error) {
+	if str == "" {
+		return pswdstring, nil
+	}
+	if p, ok := charset_presets[str]; ok {
+		return p, nil
+	}
+	seen := make(map[byte]bool)
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		if c == ':' {
+			return "", errors.New("Password charset can not contain a :")
+		}
+		if c <= 0x20 || c > 0x7e {
+			return "", errors.New("Password charset can only contain printable ASCII, not spaces")
+		}
+		// A repeated character would be picked more often than the others
+		if seen[c] {
+			return "", errors.New("Password charset has " + string(c) + " more than once")
+		}
+		seen[c] = true
+	}
+	if len(str) < 2 {
+		return "", errors.New("Password charset needs at least 2 characters")
+	}
+	return str, nil
+}
+
+// How long generated passwords are.  Some safe firmware won't take
+// anything longer than 64.
+var password_length int
+
+const min_password_length = 8
+const max_password_length = 64
+const default_password_length = 30
+
 // Information we read from the config file
 type Configuration struct {
-	Safe string
-	User string
-	Pass string
+	Safe        string
+	Safes       []string
+	User        string
+	Pass        string
+	PassFile    string
+	URLTemplate string
+	BasePath    string
+	CACert      string
+	UserAgent   string
+	Scheme      string
+	Timeout     int
+	Post        bool
+	Auth        string
+	Token       string
+	SignKey     string
+	OnLock      string
+	OnUnlock    string
+	LogFile     string
+	LockDir     string
+	ServeUser   string
+	ServePass   string
+	Length      int
+	Charset     string
+	Profiles    map[string]Profile
+}
+
+// A named safe in the config file
+type Profile struct {
+	Safe     string
+	User     string
+	Pass     string
+	PassFile string
 }
 
 var configuration Configuration
 
 // Make these global so they're easy to use, rather than passing them through
-// a chain of main->{function}->talk_to_safe
+// a chain of main->{function}->safe_request
 var username, passwd, safe string
 
+// One address the safe may be at.  Each has its own scheme and path,
+// so a list can be e.g. https://proxy/emla/ and then the safe itself.
+type safe_address struct {
+	host, scheme, base string
+}
+
+func (a safe_address) String() string {
+	return a.scheme + "://" + a.host + a.base
+}
+
+// The addresses the safe may be at, tried in turn until one answers.
+// safe, scheme and base_path are for the one being tried; once it has
+// answered it's kept for the rest of the run, so a lock and its check go
+// to the same place.
+var safes []safe_address
+var safe_found bool
+
+// Talk to this address from now on
+func use_safe(a safe_address) {
+	safe, scheme, base_path = a.host, a.scheme, a.base
+}
+
+// The address being tried
+func current_safe() safe_address {
+	return safe_address{safe, scheme, base_path}
+}
+
+// Move on to the next address, if there is one
+func next_safe() bool {
+	for i, s := range safes[:len(safes)-1] {
+		if s == current_safe() {
+			use_safe(safes[i+1])
+			return true
+		}
+	}
+	return false
+}
+
+// Extra information about what we're doing goes to stderr
+var verbose bool
+
+// Only errors and the output that was asked for
+var quiet bool
+
+// Carry on even if safety checks fail, and overwrite existing files
+var force bool
+
+// Lock a safe that's already locked, replacing its password
+var relock bool
+
+// With -keyfile, also keep the password in this file
+var keyfile string
+
+// With -show-password, print the new password once the lock is made
+var show_password bool
+
+// With -rekey, the password the safe is locked with now, and the image
+// it came from
+var rekey_from, rekey_image string
+
+// Go through -lock without locking the safe or writing the image
+var dry_run bool
+
+// Warn if a lock image is older than this
+var max_age time.Duration
+
+// How hard to try checking the safe accepted a new password
+var verify_retries int
+var verify_delay time.Duration
+
 //////////////////////////////////////////////////////////////////////
 //
 // JPEG file handling
 //
+// The file format itself is dealt with by the carrier package; this is
+// where our password goes in it.
+//
 //////////////////////////////////////////////////////////////////////
 
-// These are the fields we care about keeping
-type JPEG struct {
-	dqt      [10][]byte
-	comment  []byte
-	sof0     []byte
-	dht      [10][]byte
-	sos      []byte
-	img      []byte
-	dqtcount int
-	dhtcount int
+// Marks a password block appended after the EOI marker.  The block is
+// laid out as payload, 4 byte big-endian payload length, then this magic,
+// so it can be found by scanning back from the end of the file.
+const trailer_magic = "PICTURE_LOCK"
+
+// Should the password go into the trailer rather than the comment?
+var use_trailer bool
+
+// Should the password be hidden in the pixels instead?
+var use_steg bool
+
+// Remove the source image's own comments, rather than keep them
+var strip_comments bool
+
+// If there's no source image, generate one from this description
+var placeholder string
+
+// Re-encode the source at this JPEG quality before embedding (0 = don't)
+var quality int
+
+// Should we test the image can be written and re-read before locking?
+var verify_image bool
+
+// Should we check the payload will survive tools that mangle non-ASCII?
+var charset_check bool
+
+// Look backwards through trailing data for our password block.  Returns
+// the payload, and the trailer with the block removed.
+func find_trailer(trailer []byte) ([]byte, []byte, bool) {
+	idx := bytes.LastIndex(trailer, []byte(trailer_magic))
+	if idx < 4 {
+		return nil, trailer, false
+	}
+	size := int(binary.BigEndian.Uint32(trailer[idx-4 : idx]))
+	start := idx - 4 - size
+	if size < 0 || start < 0 {
+		return nil, trailer, false
+	}
+	rest := append([]byte{}, trailer[:start]...)
+	rest = append(rest, trailer[idx+len(trailer_magic):]...)
+	return trailer[start : idx-4], rest, true
 }
 
-var lock_image JPEG
+// Append a password block to the trailing data, replacing any of ours
+// that was already there
+func add_trailer(trailer []byte, payload []byte) []byte {
+	_, res, _ := find_trailer(trailer)
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	// res may share its array with the source image, so don't write
+	// into that
+	res = append(res[:len(res):len(res)], payload...)
+	res = append(res, size[:]...)
+	return append(res, []byte(trailer_magic)...)
+}
 
-func read_jpeg_segment(img []byte, offset int) (int, int, []byte, error) {
-	var segment int
-	var size int
-	var res []byte
-	if img[offset] != 0xff {
-		return 0, 0, nil, errors.New("Bad JPEG - expected 0xff at " + strconv.Itoa(offset))
+func read_jpeg(filename string) (carrier.JPEG, error) {
+	img, err := read_file(filename)
+	if err != nil {
+		return carrier.JPEG{}, err
 	}
-	segment = int(img[offset+1])
-	size = int(img[offset+2])*256 + int(img[offset+3])
-	res = img[offset+4 : offset+4+size-2]
-	return segment, size, res, nil
+	return carrier.Parse(img)
 }
 
-func write_jpeg_segment(f io.Writer, marker int, data []byte) {
-	var buf [4]byte
-	l := len(data) + 2
-	buf[0] = 0xff
-	buf[1] = byte(marker)
-	buf[2] = byte(l >> 8)
-	buf[3] = byte(l & 255)
-	f.Write(buf[:4])
-	f.Write(data)
+// Colours that can be used for placeholder images, as well as #rrggbb
+var placeholder_colours = map[string]color.RGBA{
+	"black": {0, 0, 0, 255},
+	"white": {255, 255, 255, 255},
+	"grey":  {128, 128, 128, 255},
+	"gray":  {128, 128, 128, 255},
+	"red":   {255, 0, 0, 255},
+	"green": {0, 128, 0, 255},
+	"blue":  {0, 0, 255, 255},
+	"pink":  {255, 192, 203, 255},
 }
 
-func parse_jpeg(img []byte) (JPEG, error) {
-	var image JPEG
+// Build a plain single colour JPEG from a "WxH [colour]" description,
+// for when there's no source image to hand
+func make_placeholder(spec string) (carrier.JPEG, error) {
+	var res carrier.JPEG
+	fields := strings.Fields(strings.Replace(spec, ",", " ", -1))
+	if len(fields) == 0 || len(fields) > 2 {
+		return res, errors.New("Placeholder should be WxH or WxH colour, e.g. 640x480 blue")
+	}
 
-	if img[0] != 0xff && img[1] != 0xd8 {
-		return image, errors.New("Image is not a JPEG - bad header")
+	var w, h int
+	dims := strings.SplitN(strings.ToLower(fields[0]), "x", 2)
+	if len(dims) == 2 {
+		w, _ = strconv.Atoi(dims[0])
+		h, _ = strconv.Atoi(dims[1])
 	}
-	if img[len(img)-2] != 0xff && img[len(img)-1] != 0xd9 {
-		return image, errors.New("Image is not a JPEG - bad footer")
+	if w < 1 || h < 1 || w > 4000 || h > 4000 {
+		return res, errors.New("Bad placeholder size " + fields[0] + "; should be WxH, each between 1 and 4000")
 	}
-	offset := 2
 
-	for {
-		section, size, data, err := read_jpeg_segment(img, offset)
-		if err != nil {
-			return image, err
-		}
-		offset += size + 2
-		if section == 0xfe {
-			image.comment = data
-		} else if section == 0xc0 {
-			image.sof0 = data
-		} else if section == 0xda {
-			image.sos = data
-			break
-		} else if section == 0xdb {
-			image.dqt[image.dqtcount] = data
-			image.dqtcount++
-			if image.dqtcount > 9 {
-				return image, errors.New("Too many DQT segments")
-			}
-		} else if section == 0xc4 {
-			image.dht[image.dhtcount] = data
-			image.dhtcount++
-			if image.dhtcount > 9 {
-				return image, errors.New("Too many DHT segments")
+	col := placeholder_colours["black"]
+	if len(fields) == 2 {
+		name := strings.ToLower(fields[1])
+		c, ok := placeholder_colours[name]
+		if !ok {
+			rgb, err := hex.DecodeString(strings.TrimPrefix(name, "#"))
+			if err != nil || len(rgb) != 3 {
+				return res, errors.New("Unknown placeholder colour " + fields[1])
 			}
+			c = color.RGBA{rgb[0], rgb[1], rgb[2], 255}
 		}
+		col = c
 	}
-	image.img = img[offset : len(img)-2]
 
-	return image, nil
-}
+	img := image.NewRGBA(image.Rect(0, 0, w, h))
+	draw.Draw(img, img.Bounds(), &image.Uniform{col}, image.Point{}, draw.Src)
 
-func read_jpeg(filename string) (JPEG, error) {
-	img, err := ioutil.ReadFile(filename)
+	var buf bytes.Buffer
+	err := jpeg.Encode(&buf, img, nil)
 	if err != nil {
-		return lock_image, errors.New("Could not open file " + filename)
+		return res, errors.New("Could not create placeholder image: " + err.Error())
 	}
-	return parse_jpeg(img)
+	return carrier.Parse(buf.Bytes())
 }
 
-func write_jpeg(f io.Writer, image JPEG) {
-	var head [2]byte
-	head[0] = 0xff
-	head[1] = 0xd8
-	var foot [2]byte
-	foot[0] = 0xff
-	foot[1] = 0xd9
+// Recompress an image at the given quality.  This makes new image data,
+// so anything else in the file (e.g. an old comment) is lost.
+func reencode_jpeg(image carrier.JPEG, q int) (carrier.JPEG, error) {
+	img, err := jpeg.Decode(bytes.NewReader(jpeg_bytes(image)))
+	if err != nil {
+		return image, errors.New("Could not decode image to re-encode it: " + err.Error())
+	}
 
-	f.Write(head[:2])
-	write_jpeg_segment(f, 0xfe, image.comment)
-	for i := 0; i < image.dqtcount; i++ {
-		write_jpeg_segment(f, 0xdb, image.dqt[i])
+	var buf bytes.Buffer
+	err = jpeg.Encode(&buf, img, &jpeg.Options{Quality: q})
+	if err != nil {
+		return image, errors.New("Could not re-encode image: " + err.Error())
 	}
-	write_jpeg_segment(f, 0xc0, image.sof0)
-	for i := 0; i < image.dhtcount; i++ {
-		write_jpeg_segment(f, 0xc4, image.dht[i])
+	return carrier.Parse(buf.Bytes())
+}
+
+// Decode a source image of any supported format into pixels
+func decode_any_image(filename string, data []byte) (image.Image, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errors.New("Could not decode " + filename + ": " + err.Error())
 	}
-	write_jpeg_segment(f, 0xda, image.sos)
-	f.Write(image.img)
-	f.Write(foot[:2])
+	return img, nil
+}
+
+func jpeg_bytes(image carrier.JPEG) []byte {
+	return carrier.Bytes(image)
 }
 
 //////////////////////////////////////////////////////////////////////
 //
-// Utility functions
+// Password embedding
 //
 //////////////////////////////////////////////////////////////////////
 
-func abort(str string) {
-	fmt.Fprintln(os.Stderr, "\n"+str)
-	os.Exit(-1)
+// Put the payload into the image, and make sure there's no stale
+// password (or share) left in the other places
+func embed_password(image *carrier.JPEG, payload []byte) error {
+	if strip_comments {
+		carrier.StripComments(image)
+	}
+	carrier.SetComment(image, payload_prefix, nil)
+	carrier.SetComment(image, share_prefix, nil)
+	_, image.Trailer, _ = find_trailer(image.Trailer)
+	if err := set_xmp_payload(image, nil); err != nil {
+		return err
+	}
+	if use_trailer {
+		image.Trailer = add_trailer(image.Trailer, payload)
+	} else if use_xmp {
+		return set_xmp_payload(image, payload)
+	} else {
+		carrier.SetComment(image, string(payload[:len(payload_prefix)]), payload)
+	}
+	return nil
 }
 
-// Where do config files live?
-func UserHomeDir() string {
-	if runtime.GOOS == "windows" {
-		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
-		if home == "" {
-			home = os.Getenv("USERPROFILE")
+// Some tools assume comments are ASCII or Latin-1 and will mangle
+// anything else, so check the payload is plain printable ASCII
+func check_payload_charset(payload []byte) error {
+	for i, c := range payload {
+		if c < 0x20 || c > 0x7e {
+			return errors.New("Payload has a non-printable byte " + strconv.Itoa(int(c)) + " at offset " + strconv.Itoa(i))
 		}
-		return home + "\\"
 	}
-	return os.Getenv("HOME") + "/"
+	return nil
 }
 
-//////////////////////////////////////////////////////////////////////
-//
-// Talk to Safe
-//
-//////////////////////////////////////////////////////////////////////
+// The places a password can be hidden in an image
+type Store struct {
+	name string
+	get  func(carrier.JPEG) ([]byte, bool)
+}
+
+var stores = []Store{
+	{"comment", func(image carrier.JPEG) ([]byte, bool) {
+		if payload, ok := carrier.GetComment(image, payload_prefix); ok {
+			return payload, ok
+		}
+		return carrier.GetComment(image, share_prefix)
+	}},
+	{"trailer", func(image carrier.JPEG) ([]byte, bool) {
+		payload, _, ok := find_trailer(image.Trailer)
+		return payload, ok
+	}},
+	{"xmp", xmp_payload},
+}
 
-func talk_to_safe(cmd string) string {
-	url := "http://" + safe + "/safe/?" + cmd
-	// fmt.Println("We want to to " + url)
+// Which stores to look in, and in what order.  Comma separated list
+// of store names
+var search_order string
 
-	req, err := http.NewRequest("GET", url, nil)
-	if err != nil {
-		// Ensure error doesn't have cmd in it...
-		msg := strings.Replace(err.Error(), cmd, "*******", 1)
-		abort("Got error setting up http request: " + msg)
+func find_store(name string) (Store, bool) {
+	for _, st := range stores {
+		if st.name == name {
+			return st, true
+		}
 	}
+	return Store{}, false
+}
 
-	req.SetBasicAuth(username, passwd)
+func check_search_order() error {
+	for _, name := range strings.Split(search_order, ",") {
+		if _, ok := find_store(strings.TrimSpace(name)); !ok {
+			return errors.New("Unknown store in -search-order: " + name)
+		}
+	}
+	return nil
+}
 
-	client := &http.Client{}
-	resp, err := client.Do(req)
-	if err != nil {
-		msg := strings.Replace(err.Error(), cmd, "*******", 1)
-		abort("Problems talking to the safe: " + msg)
+// Look through each store in turn and use the first password we find.
+// Returns the store it came from, too.
+func extract_password(image carrier.JPEG) (LockInfo, string, error) {
+	var bad error
+	for _, name := range strings.Split(search_order, ",") {
+		st, ok := find_store(strings.TrimSpace(name))
+		if !ok {
+			continue
+		}
+		payload, ok := st.get(image)
+		if !ok {
+			continue
+		}
+		_, info, err := decode_payload(payload)
+		if err == no_payload {
+			continue
+		}
+		// A damaged copy shouldn't stop us using a good one elsewhere
+		if err != nil {
+			bad = err
+			verbose_msg("Ignoring password in " + st.name + ": " + err.Error())
+			continue
+		}
+		return info, st.name, nil
+	}
+	if bad != nil {
+		return LockInfo{}, "", bad
 	}
+	return LockInfo{}, "", missing_payload(image)
+}
 
-	// Get the response as a string
-	//   http://dlintw.github.io/gobyexample/public/http-client.html
-	body, err := ioutil.ReadAll(resp.Body)
-	if err != nil {
-		abort("Problems getting response from safe: " + err.Error())
+// Say why there's no password, as far as the comments go: there may be
+// none at all, or only ones some other program wrote
+func missing_payload(image carrier.JPEG) error {
+	comments := 0
+	for _, s := range image.Segments {
+		if s.Marker == carrier.COM {
+			comments++
+		}
 	}
-	res := string(body)
+	switch comments {
+	case 0:
+		return errors.New(no_payload.Error() + ": it has no comment, so may have been saved by a program that removes them")
+	case 1:
+		return errors.New(no_payload.Error() + ": it has a comment, but not one holding a password")
+	}
+	return errors.New(no_payload.Error() + ": it has " + strconv.Itoa(comments) + " comments, but none of them holds a password")
+}
 
-	if resp.StatusCode != 200 {
-		abort("Bad result from safe: " + resp.Status + "\n" + res)
+// Find the password in a PNG's text chunk
+func extract_png_password(image PNG) (LockInfo, error) {
+	payload, ok := png_text(image)
+	if !ok {
+		return LockInfo{}, no_payload
 	}
-	return res
+	_, info, err := decode_payload(payload)
+	return info, err
 }
 
-//////////////////////////////////////////////////////////////////////
-//
-// Main functions
-//
-//////////////////////////////////////////////////////////////////////
+// Find the password in an image file's contents; first the JPEG, PNG,
+// GIF, WebP, TIFF or BMP metadata, then hidden in the pixels
+func read_lock_info(data []byte) (LockInfo, string, error) {
+	var meta_err error
+	if is_png(data) {
+		var image PNG
+		image, meta_err = parse_png(data)
+		if meta_err == nil {
+			info, err := extract_png_password(image)
+			if err == nil {
+				return info, "text", nil
+			}
+			meta_err = err
+		}
+	} else if is_gif(data) {
+		var image GIF
+		image, meta_err = parse_gif(data)
+		if meta_err == nil {
+			info, err := extract_gif_password(image)
+			if err == nil {
+				return info, "comment", nil
+			}
+			meta_err = err
+		}
+	} else if is_webp(data) {
+		var image WebP
+		image, meta_err = parse_webp(data)
+		if meta_err == nil {
+			info, err := extract_webp_password(image)
+			if err == nil {
+				return info, "chunk", nil
+			}
+			meta_err = err
+		}
+	} else if is_tiff(data) {
+		var image TIFF
+		image, meta_err = parse_tiff(data)
+		if meta_err == nil {
+			info, err := extract_tiff_password(image)
+			if err == nil {
+				return info, "tag", nil
+			}
+			meta_err = err
+		}
+	} else if is_bmp(data) {
+		var image BMP
+		image, meta_err = parse_bmp(data)
+		if meta_err == nil {
+			info, err := extract_bmp_password(image)
+			if err == nil {
+				return info, "trailer", nil
+			}
+			meta_err = err
+		}
+	} else {
+		var image carrier.JPEG
+		image, meta_err = carrier.Parse(data)
+		if meta_err == nil {
+			info, where, err := extract_password(image)
+			if err == nil {
+				return info, where, nil
+			}
+			meta_err = err
+		}
+	}
 
-func lock(src, dest string) {
-	if src == "" {
-		abort("Missing --source file")
+	info, err := extract_from_pixels(data)
+	if err != nil {
+		return LockInfo{}, "", meta_err
 	}
+	return info, "pixels", nil
+}
 
-	if src == dest {
-		abort("Source and destination names can not be the same")
+// Hide most of a password so it can be shown safely
+func mask(psw string) string {
+	if len(psw) <= 6 {
+		return strings.Repeat("*", len(psw))
 	}
+	return psw[:2] + strings.Repeat("*", len(psw)-4) + psw[len(psw)-2:]
+}
 
-	fmt.Println("Creating a new lock")
-	lock_image, err := read_jpeg(src)
+// Report on every store in the image, without talking to the safe
+func test_all_stores(file string) error {
+	data, err := read_file(file)
 	if err != nil {
-		abort(err.Error())
+		return err
 	}
 
-	// Generate a random password
-	b := make([]byte, 30)
-	for i := range b {
-		b[i] = pswdstring[rand.Intn(len(pswdstring))]
+	found := 0
+	agree := true
+	var first string
+	seen := func(name string, info LockInfo) {
+		value := info.Password
+		if info.Share != "" {
+			fmt.Println(name + ": " + describe_share(info))
+			value = info.Share
+		} else {
+			fmt.Println(name + ": " + mask(info.Password))
+		}
+		if found == 0 {
+			first = value
+		} else if value != first {
+			agree = false
+		}
+		found++
 	}
-	new_pswd := string(b)
-	// DEBUG
-	// new_pswd = "hello"
 
-	// Lock the safe
-	res := talk_to_safe("lock=1&lock1=" + new_pswd + "&lock2=" + new_pswd)
-	if res != "Safe locked" {
-		abort("Problem locking safe: " + res)
+	report := func(name string, payload []byte, ok bool) {
+		if !ok {
+			fmt.Println(name + ": not present")
+			return
+		}
+		_, info, err := decode_payload(payload)
+		if err == no_payload {
+			fmt.Println(name + ": present, no password")
+			return
+		}
+		if err != nil {
+			fmt.Println(name + ": " + mask(info.Password) + " (" + err.Error() + ")")
+			return
+		}
+		seen(name, info)
 	}
 
-	// Check the password was accepted
-	res = talk_to_safe("pwtest=1&unlock=" + new_pswd)
-	if res != "Passwords match" {
-		abort("Unable to verify lock worked: " + res)
+	if is_png(data) {
+		image, err := parse_png(data)
+		if err != nil {
+			fmt.Println("Bad PNG (" + err.Error() + "); only the pixels can be checked")
+		} else {
+			payload, ok := png_text(image)
+			report("text", payload, ok)
+		}
+	} else if is_gif(data) {
+		image, err := parse_gif(data)
+		if err != nil {
+			fmt.Println("Bad GIF (" + err.Error() + "); only the pixels can be checked")
+		} else {
+			payload, ok := gif_comment(image)
+			report("comment", payload, ok)
+		}
+	} else if is_webp(data) {
+		image, err := parse_webp(data)
+		if err != nil {
+			fmt.Println("Bad WebP (" + err.Error() + "); only the pixels can be checked")
+		} else {
+			payload, ok := webp_payload(image)
+			report("chunk", payload, ok)
+		}
+	} else if is_tiff(data) {
+		image, err := parse_tiff(data)
+		if err != nil {
+			fmt.Println("Bad TIFF (" + err.Error() + "); only the pixels can be checked")
+		} else {
+			payload, ok := tiff_payload(image)
+			report("tag", payload, ok)
+		}
+	} else if is_bmp(data) {
+		image, err := parse_bmp(data)
+		if err != nil {
+			fmt.Println("Bad BMP (" + err.Error() + "); only the pixels can be checked")
+		} else {
+			report("trailer", image.payload, len(image.payload) > 0)
+		}
+	} else if image, err := carrier.Parse(data); err != nil {
+		fmt.Println("Not a JPEG (" + err.Error() + "); only the pixels can be checked")
+	} else {
+		for _, st := range stores {
+			payload, ok := st.get(image)
+			report(st.name, payload, ok)
+		}
+	}
+
+	if info, err := extract_from_pixels(data); err != nil {
+		fmt.Println("pixels: not present")
+	} else {
+		seen("pixels", info)
 	}
 
-	// Now embed the password in the image
-	lock_image.comment = []byte("LOCKPSW:" + new_pswd)
+	if found == 0 {
+		fmt.Println("No password found")
+		return nil
+	}
+	if found > 1 {
+		if agree {
+			fmt.Println("All copies agree")
+		} else {
+			fmt.Println("WARNING: copies do not agree")
+		}
+	}
 
-	// Save the new image
-	f, err := os.Create(dest)
-	if err != nil {
-		talk_to_safe("unlock_all=1&unlock=" + new_pswd)
-		abort("We could not create the image file.  We have attempted to unlock the safe\nJust in case there was a problem the password generated was\n  " + new_pswd + "\nThe failure was: " + err.Error())
+	if _, where, err := read_lock_info(data); err != nil {
+		fmt.Println(err.Error())
+	} else {
+		fmt.Println("-unlock would use " + where)
 	}
-	write_jpeg(f, lock_image)
-	f.Close()
-	fmt.Println(dest + " created.")
+	return nil
 }
 
-func unlock(file string, tst bool) {
-	lock_image, err := read_jpeg(file)
+// Old images may be for a lock that has since been replaced
+func check_age(info LockInfo) {
+	if max_age <= 0 {
+		return
+	}
+	if info.Created == "" {
+		fmt.Fprintln(os.Stderr, "Warning: this image has no creation time so its age can not be checked")
+		return
+	}
+	created, err := time.Parse(time.RFC3339, info.Created)
 	if err != nil {
-		abort(err.Error())
+		fmt.Fprintln(os.Stderr, "Warning: this image has a bad creation time: "+info.Created)
+		return
+	}
+	age := time.Since(created)
+	if age > max_age {
+		fmt.Fprintln(os.Stderr, "Warning: this image was created "+created.Local().Format(time.RFC1123)+", "+age.Round(time.Minute).String()+" ago.\nCheck it is for the current lock.")
 	}
+}
 
-	psw := string(lock_image.comment)
+//////////////////////////////////////////////////////////////////////
+//
+// Utility functions
+//
+//////////////////////////////////////////////////////////////////////
 
-	if strings.HasPrefix(psw, "LOCKPSW:") {
-		psw = psw[8:]
+// Read a whole file, or stdin if the name is -
+func read_file(filename string) ([]byte, error) {
+	var data []byte
+	var err error
+	if filename == "-" {
+		data, err = ioutil.ReadAll(os.Stdin)
 	} else {
-		abort("This is not a valid password image")
+		data, err = ioutil.ReadFile(filename)
 	}
-
-	cmd := "unlock_all"
-	if tst {
-		cmd = "pwtest"
+	if err != nil {
+		return nil, errors.New("Could not open file " + filename)
 	}
+	return data, nil
+}
+
+//////////////////////////////////////////////////////////////////////
+//
+// Exit codes
+//
+// So scripts can tell what went wrong: 0 is success, 1 anything not
+// covered below (and -status finding changes), 2 a bad command line, 3
+// a problem with the config file, 4 an image that can't be read or
+// used, 5 trouble talking to the safe and 6 a password the safe didn't
+// accept, either checking a new lock or with -test.  130 is the usual
+// code for being stopped by Ctrl-C.
+//
+//////////////////////////////////////////////////////////////////////
 
-	fmt.Println(talk_to_safe(cmd + "=1&unlock=" + psw))
+const (
+	exit_failure = 1
+	exit_usage   = 2
+	exit_config  = 3
+	exit_image   = 4
+	exit_safe    = 5
+	exit_verify  = 6
+	exit_busy    = 7
+
+	exit_interrupted = 130
+)
+
+// An error that knows which exit code it should give
+type coded_error struct {
+	code int
+	err  error
 }
 
-func main() {
-	// Let's seed our random function
-	rand.Seed(time.Now().UnixNano())
+func (e coded_error) Error() string {
+	return e.err.Error()
+}
 
-	// Try and find the config file
-	config_file := UserHomeDir() + ".picture_lock"
-	if _, err := os.Stat(config_file); err == nil {
-		// fmt.Println("Using configuration file " + config_file)
+// Give an error an exit code, unless it already has a more specific one
+func with_code(code int, err error) error {
+	if err == nil || exit_code(err) != exit_failure {
+		return err
+	}
+	return coded_error{code, err}
+}
 
-		parse := gonfig.GetConf(config_file, &configuration)
-		if parse != nil {
-			abort("Error parsing " + config_file + ": " + parse.Error())
-		}
+func exit_code(err error) int {
+	switch e := err.(type) {
+	case coded_error:
+		return e.code
+	case auth_error, transient_error:
+		return exit_safe
 	}
+	return exit_failure
+}
 
-	flag.StringVar(&username, "user", "", "Username to talk to safe (optional)")
-	flag.StringVar(&passwd, "pass", "", "Password to talk to safe (optional)")
-	flag.StringVar(&safe, "safe", "", "Safe Address")
+// A -lock stopped by Ctrl-C (or SIGTERM)
+var interrupted error = coded_error{exit_interrupted, errors.New("Interrupted")}
 
-	source := flag.String("source", "", "Source Image (needed for -lock)")
-	lockflag := flag.Bool("lock", false, "Lock the safe, create new image")
-	unlockflag := flag.Bool("unlock", false, "Unlock the safe with image")
-	testflag := flag.Bool("test", false, "Test the image can unlock the safe")
-	statusflag := flag.Bool("status", false, "Request current safe status")
+// What we were doing, for errors given as JSON: "setup" until the
+// command line and config file are dealt with, then the command
+var stage = "setup"
 
-	flag.Parse()
+// With -json, a fatal error is reported like this on stderr
+type ErrorReport struct {
+	Error string
+	Code  int
+	Stage string
+}
 
-	// If the user didn't define these three things, use values
-	// from the config file
-	if username == "" {
-		username = configuration.User
+func abort(code int, str string) {
+	if json_output {
+		// Cleaned before encoding, as JSON escaping could hide a password
+		data, _ := json.Marshal(ErrorReport{redact(str), code, stage})
+		fmt.Fprintln(os.Stderr, string(data))
+		os.Exit(code)
 	}
+	fmt.Fprintln(os.Stderr, "\n"+str)
+	os.Exit(code)
+}
 
-	if passwd == "" {
-		passwd = configuration.Pass
+// For progress and success messages, which -quiet turns off
+func info_msg(w io.Writer, str string) {
+	if !quiet {
+		fmt.Fprintln(w, str)
 	}
+}
 
-	if safe == "" {
-		safe = configuration.Safe
+func verbose_msg(str string) {
+	if verbose {
+		fmt.Fprintln(os.Stderr, str)
 	}
+}
 
-	// Safe better be defined!
-	if safe == "" {
-		abort("No safe name passed")
-	}
+// Below this many bits a password could be guessed by brute force
+const min_entropy_bits = 64
 
-	if *statusflag {
-		fmt.Println(talk_to_safe("status=1"))
-		os.Exit(0)
+// How many bits of entropy a random password of this length has, with
+// each character picked from a set of this size
+func password_entropy(length, set_size int) float64 {
+	return float64(length) * math.Log2(float64(set_size))
+}
+
+// Use crypto/rand so the password can't be guessed from when we locked.
+// Random bytes at or above the largest multiple of len(charset) are
+// thrown away so every character is equally likely.
+func generate_password() (string, error) {
+	b := make([]byte, password_length)
+	limit := 256 - 256%len(charset)
+	var buf [64]byte
+	for i := 0; i < len(b); {
+		_, err := rand.Read(buf[:])
+		if err != nil {
+			return "", errors.New("Could not generate a random password: " + err.Error())
+		}
+		for _, c := range buf {
+			if int(c) >= limit {
+				continue
+			}
+			b[i] = charset[int(c)%len(charset)]
+			i++
+			if i == len(b) {
+				break
+			}
+		}
 	}
+	return string(b), nil
+}
 
-	args := flag.Args()
+// With -set-password, the password to lock with instead of a random
+// one; "-" asks for it on the terminal
+var set_password string
 
-	if len(args) == 0 {
-		abort("Missing filename; use the -h option for help")
-	} else if len(args) != 1 {
-		abort("Only one filename is allowed and must be the last value;\n  use the \"-h\" option for help")
+// A chosen password still has to be one we could have generated, so it
+// fits the payload and the safe takes it
+func check_chosen_password(psw string) error {
+	if len(psw) < min_password_length || len(psw) > max_password_length {
+		return errors.New("The password must be between " + strconv.Itoa(min_password_length) + " and " + strconv.Itoa(max_password_length) + " characters long")
 	}
+	for i := 0; i < len(psw); i++ {
+		if strings.IndexByte(charset, psw[i]) == -1 {
+			msg := "The password has " + strconv.Quote(psw[i:i+1]) + " at character " + strconv.Itoa(i+1) + ", which isn't in the -charset"
+			if strings.IndexByte(charset_presets["full"], psw[i]) != -1 {
+				msg += "; -charset full allows it"
+			}
+			return errors.New(msg)
+		}
+	}
+	return nil
+}
 
-	filename := args[0]
-
-	if *lockflag {
-		lock(*source, filename)
+// A chosen password isn't random, so this is only a hint: the bits it
+// would have if each character was picked from every character of the
+// kinds used.  Real ones are easier to guess than that.
+func chosen_entropy(psw string) float64 {
+	size := 0
+	for _, k := range []string{"abcdefghijklmnopqrstuvwxyz", "ABCDEFGHIJKLMNOPQRSTUVWXYZ", "0123456789"} {
+		if strings.ContainsAny(psw, k) {
+			size += len(k)
+		}
+	}
+	other := false
+	for i := 0; i < len(psw); i++ {
+		if strings.IndexByte(pswdstring, psw[i]) == -1 {
+			other = true
+		}
+	}
+	if other {
+		size += len(charset_presets["full"]) - len(pswdstring)
+	}
+	return password_entropy(len(psw), size)
+}
+
+// Ask for the password twice, so a typo doesn't lock the safe with a
+// password nobody knows
+func ask_chosen_password() (string, error) {
+	psw, err := ask_password("Password to lock the safe with: ")
+	if err != nil {
+		return "", err
+	}
+	again, err := ask_password("Again: ")
+	if err != nil {
+		return "", err
+	}
+	if psw != again {
+		return "", errors.New("The passwords don't match")
+	}
+	return psw, nil
+}
+
+// Passwords that must never appear in messages
+var secrets []string
+var secrets_mutex sync.Mutex
+
+// Logins and tokens shorter than this aren't scrubbed: a short one
+// (e.g. "image") would be found inside ordinary words and garble every
+// message.  Passwords sent to the safe always are, see add_password.
+const min_secret_length = min_password_length
+
+func add_secret(str string) {
+	if len(str) < min_secret_length {
+		return
+	}
+	add_password(str)
+}
+
+// The command parameters that carry a password to the safe
+var password_params = []string{"unlock", "lock1", "password"}
+
+// Their values in a URL or form, to scrub however short they are
+var password_param = regexp.MustCompile(`\b(` + strings.Join(password_params, "|") + `)=[^&\s"'<>]*`)
+
+// A password going to the safe is scrubbed whatever its length, as it
+// may be in the URL, and so in messages
+func add_password(str string) {
+	if str == "" {
+		return
+	}
+	secrets_mutex.Lock()
+	defer secrets_mutex.Unlock()
+	for _, s := range secrets {
+		if s == str {
+			return
+		}
+	}
+	secrets = append(secrets, str)
+}
+
+// Some servers (and proxies) echo URLs back with lower case escapes,
+// e.g. %2f rather than %2F
+var percent_escape = regexp.MustCompile(`%[0-9A-F]{2}`)
+
+func lower_escapes(str string) string {
+	return percent_escape.ReplaceAllStringFunc(str, strings.ToLower)
+}
+
+// Scrub every known password out of a message, everywhere it appears.
+// As well as the plain text we look for the forms it takes when put
+// into a URL, since that's how they turn up in errors from the http
+// library.
+func redact(str string) string {
+	var forms []string
+	secrets_mutex.Lock()
+	for _, s := range secrets {
+		for _, e := range []string{url.QueryEscape(s), url.PathEscape(s)} {
+			forms = append(forms, e, lower_escapes(e))
+		}
+		forms = append(forms, s)
+	}
+	secrets_mutex.Unlock()
+	// Longest first, so a password that contains another one is
+	// removed whole
+	sort.Slice(forms, func(i, j int) bool { return len(forms[i]) > len(forms[j]) })
+	for _, f := range forms {
+		str = strings.ReplaceAll(str, f, "*******")
+	}
+	return password_param.ReplaceAllString(str, "${1}=*******")
+}
+
+// Write to a file that other copies of this program may also be using,
+// holding a lock so they take turns.  Either append to the file or
+// replace what's there.
+func write_state_file(path string, data []byte, append_data bool) error {
+	mode := os.O_CREATE | os.O_WRONLY
+	if append_data {
+		mode |= os.O_APPEND
+	}
+	f, err := os.OpenFile(path, mode, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	err = lock_file(f)
+	if err != nil {
+		return err
+	}
+	defer unlock_file(f)
+
+	// Only safe to empty the file once we hold the lock
+	if !append_data {
+		err = f.Truncate(0)
+		if err != nil {
+			return err
+		}
+	}
+	_, err = f.Write(data)
+	return err
+}
+
+// Commands to run after the safe is locked or unlocked
+var on_lock, on_unlock string
+
+// Our environment, without any PICTURE_LOCK_* variables we were given
+// (PICTURE_LOCK_PASS is the safe's password), and with the ones saying
+// what happened
+func hook_environment(operation, image, result string) []string {
+	var env []string
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "PICTURE_LOCK_") {
+			env = append(env, e)
+		}
+	}
+	return append(env,
+		"PICTURE_LOCK_OPERATION="+operation,
+		"PICTURE_LOCK_SAFE="+safe,
+		"PICTURE_LOCK_IMAGE="+image,
+		"PICTURE_LOCK_RESULT="+redact(result))
+}
+
+// Run a user's hook command through the shell.  It's told what we did
+// through environment variables; never the password.  The operation has
+// already happened, so a failing hook is only a warning.
+func run_hook(hook, operation, image, result string) {
+	if hook == "" {
+		return
+	}
+
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", hook)
+	} else {
+		cmd = exec.Command("sh", "-c", hook)
+	}
+	cmd.Env = hook_environment(operation, image, result)
+	cmd.Stdout = os.Stdout
+	if image == "-" {
+		cmd.Stdout = os.Stderr
+	}
+	cmd.Stderr = os.Stderr
+
+	verbose_msg("Running " + operation + " hook")
+	if err := cmd.Run(); err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: "+operation+" hook failed: "+err.Error())
+	}
+}
+
+// The config file has the safe password in it, so like ssh with its keys
+// we complain if anyone else can read it.  Windows permissions don't map
+// onto mode bits, so aren't checked.
+func check_config_permissions(file string, info os.FileInfo) error {
+	if runtime.GOOS == "windows" {
+		return nil
+	}
+	if info.Mode().Perm()&0044 != 0 {
+		return errors.New("Config file " + file + " can be read by other users (mode " + fmt.Sprintf("%04o", info.Mode().Perm()) + "); it should be chmod 600")
+	}
+	return nil
+}
+
+// Where do config files live?
+func UserHomeDir() string {
+	if runtime.GOOS == "windows" {
+		home := os.Getenv("HOMEDRIVE") + os.Getenv("HOMEPATH")
+		if home == "" {
+			home = os.Getenv("USERPROFILE")
+		}
+		return home + "\\"
+	}
+	return os.Getenv("HOME") + "/"
+}
+
+// Read the config file, JSON or YAML.  This is just the file: gonfig
+// would also fill in fields from environment variables named after
+// them, so OnLock=... in the environment would become a hook, and
+// PICTURE_LOCK_* are meant to be the only variables we look at.
+func read_config(file string) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+	return yaml.Unmarshal(data, &configuration)
+}
+
+//////////////////////////////////////////////////////////////////////
+//
+// Talk to Safe
+//
+//////////////////////////////////////////////////////////////////////
+
+// How requests to the safe are built.  The placeholders are {scheme}
+// (http or https), {safe} (the safe address, maybe with a port), {base}
+// (the -base-path), {cmd} (the full command as a query string, e.g.
+// pwtest=1&unlock=xxx), {action} (just the command name, e.g. pwtest) and
+// {password} (the password from the command, escaped for a URL path).  So
+// firmware that wants /safe/unlock/<password> can be handled with
+// {scheme}://{safe}{base}{action}/{password}
+const default_url_template = "{scheme}://{safe}{base}?{cmd}"
+
+var url_template string
+
+// Where the safe's commands live; different if it's behind a proxy
+var base_path string
+
+const default_base_path = "/safe/"
+
+// http, or https for a safe behind a TLS proxy
+var scheme string
+
+// Send commands as POST rather than GET
+var use_post bool
+
+// File to save the most recent safe response to
+var save_response string
+
+// Sent with every request, so picture_lock shows up clearly in the
+// safe's (or a proxy's) logs
+var user_agent string
+
+func check_scheme(s string) error {
+	if s != "http" && s != "https" {
+		return errors.New("Unsupported scheme " + s + "; use http or https")
+	}
+	return nil
+}
+
+// People often type the safe as a URL, e.g. "https://safe.local/", so
+// tidy that up into just the address, and the scheme and path if it has
+// them.  It mustn't say something different from -scheme.
+func normalize_safe(addr string) (safe_address, error) {
+	var res safe_address
+	addr = strings.TrimSpace(addr)
+	if i := strings.Index(addr, "://"); i != -1 {
+		s := strings.ToLower(addr[:i])
+		if err := check_scheme(s); err != nil {
+			return res, errors.New("Unsupported scheme " + s + ":// in safe address " + addr)
+		}
+		if scheme != "" && scheme != s {
+			return res, errors.New("Safe address " + addr + " does not match -scheme " + scheme)
+		}
+		res.scheme = s
+		addr = addr[i+3:]
+	}
+	addr = strings.TrimRight(addr, "/")
+	if i := strings.Index(addr, "/"); i != -1 {
+		res.base = addr[i:]
+		addr = addr[:i]
+	}
+	if addr == "" {
+		return res, errors.New("No safe name passed")
+	}
+	res.host = addr
+	return res, nil
+}
+
+// Turn the comma separated -safe list into addresses.  Each uses the
+// scheme it was given with, or -scheme, the config file's Scheme or
+// http; and -base-path, the path it was given with, the config file's
+// BasePath or the default.
+func parse_safes(list string) ([]safe_address, error) {
+	var res []safe_address
+	for _, s := range strings.Split(list, ",") {
+		a, err := normalize_safe(s)
+		if err != nil {
+			return nil, err
+		}
+		if scheme != "" {
+			a.scheme = scheme
+		}
+		if a.scheme == "" {
+			a.scheme = strings.ToLower(configuration.Scheme)
+		}
+		if a.scheme == "" {
+			a.scheme = "http"
+		}
+		if err := check_scheme(a.scheme); err != nil {
+			return nil, err
+		}
+		if base_path != "" {
+			a.base = base_path
+		}
+		if a.base == "" {
+			a.base = configuration.BasePath
+		}
+		if a.base == "" {
+			a.base = default_base_path
+		}
+		a.base = normalize_base_path(a.base)
+
+		// The same address twice would only be tried twice
+		dup := false
+		for _, t := range res {
+			dup = dup || t == a
+		}
+		if !dup {
+			res = append(res, a)
+		}
+	}
+	return res, nil
+}
+
+// Make sure the path starts and ends with a /
+func normalize_base_path(path string) string {
+	return "/" + strings.TrimPrefix(strings.TrimSuffix(path, "/")+"/", "/")
+}
+
+// Check the URLs we'll build make sense, before trying to use them
+func check_safe_url() error {
+	str := safe_url("status=1")
+	u, err := url.Parse(str)
+	if err != nil {
+		return errors.New("Safe URL " + str + " is not valid: " + err.Error())
+	}
+	if u.Host == "" || u.Hostname() == "" {
+		return errors.New("Safe URL " + str + " has no host in it")
+	}
+	if p := u.Port(); p != "" {
+		if n, err := strconv.Atoi(p); err != nil || n < 1 || n > 65535 {
+			return errors.New("Safe port " + p + " is not valid")
+		}
+	}
+	return nil
+}
+
+func safe_url(cmd string) string {
+	params := strings.Split(cmd, "&")
+	action := strings.SplitN(params[0], "=", 2)[0]
+
+	psw := ""
+	for _, p := range params {
+		kv := strings.SplitN(p, "=", 2)
+		if len(kv) == 2 && (kv[0] == "unlock" || kv[0] == "lock1") {
+			psw, _ = url.QueryUnescape(kv[1])
+		}
+	}
+
+	// With -post the command goes in the body instead
+	query := cmd
+	if use_post {
+		query = ""
+		psw = ""
+	}
+
+	r := strings.NewReplacer(
+		"{scheme}", scheme,
+		"{safe}", safe,
+		"{base}", base_path,
+		"{cmd}", query,
+		"{action}", action,
+		"{password}", url.PathEscape(psw))
+	res := r.Replace(url_template)
+	if use_post {
+		res = strings.TrimSuffix(res, "?")
+	}
+	return res
+}
+
+// Build the request for a command, as a GET or (with -post) a form POST
+// so the password isn't in the URL and so won't end up in any logs
+func new_safe_request(ctx context.Context, cmd string) (*http.Request, error) {
+	var req *http.Request
+	var err error
+	if !use_post {
+		req, err = http.NewRequestWithContext(ctx, "GET", safe_url(cmd), nil)
+	} else {
+		req, err = http.NewRequestWithContext(ctx, "POST", safe_url(cmd), strings.NewReader(cmd))
+		if err == nil {
+			req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		}
+	}
+	if err == nil {
+		req.Header.Set("User-Agent", user_agent)
+	}
+	return req, err
+}
+
+// The safe didn't like our username/password
+type auth_error struct {
+	msg string
+}
+
+func (e auth_error) Error() string {
+	return e.msg
+}
+
+// A network problem or server error, which may go away if we try again
+type transient_error struct {
+	msg string
+}
+
+func (e transient_error) Error() string {
+	return e.msg
+}
+
+// How many times to retry after a transient error, and how long to wait
+// before the first retry; the wait doubles each time
+var retries int
+var retry_delay time.Duration
+
+// In long running modes the safe's credentials may be changed under us;
+// with -reauth we ask for new ones rather than give up
+var reauth bool
+
+// Protects username/passwd, which -reauth can change while -serve is
+// handling requests
+var creds_mutex sync.Mutex
+
+func get_credentials() (string, string) {
+	creds_mutex.Lock()
+	defer creds_mutex.Unlock()
+	return username, passwd
+}
+
+// Read a password without showing it
+func ask_password(prompt string) (string, error) {
+	fmt.Fprint(os.Stderr, prompt)
+	pass, err := term.ReadPassword(int(os.Stdin.Fd()))
+	fmt.Fprintln(os.Stderr)
+	if err != nil {
+		return "", errors.New("Could not read password: " + err.Error())
+	}
+	return string(pass), nil
+}
+
+// Just the first line, so "echo pass | picture_lock ..." works
+func read_password_stdin() (string, error) {
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && line == "" {
+		return "", errors.New("Could not read password from stdin")
+	}
+	return strings.TrimRight(line, "\r\n"), nil
+}
+
+// PassFile in the config file names a file holding just the password,
+// e.g. a Docker secret or systemd credential
+func read_pass_file(file string) (string, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", errors.New("Could not read the PassFile given in the config file: " + err.Error())
+	}
+	psw := strings.TrimRight(string(data), " \t\r\n")
+	if psw == "" {
+		return "", errors.New("The PassFile " + file + " given in the config file is empty")
+	}
+	return psw, nil
+}
+
+// Ask a yes/no question on the terminal
+func confirm(prompt string) bool {
+	fmt.Fprint(os.Stderr, prompt+" [y/N] ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	line = strings.ToLower(strings.TrimSpace(line))
+	return line == "y" || line == "yes"
+}
+
+// Ask the user for new safe credentials.  Only possible if there's
+// someone at a terminal to ask.
+func prompt_credentials(old_user, old_pass string) bool {
+	if !term.IsTerminal(int(os.Stdin.Fd())) {
+		return false
+	}
+
+	creds_mutex.Lock()
+	defer creds_mutex.Unlock()
+
+	// Someone else may have already fixed them while we waited
+	if username != old_user || passwd != old_pass {
+		return true
+	}
+
+	fmt.Fprint(os.Stderr, "The safe rejected our credentials.\nSafe username ["+username+"]: ")
+	line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil {
+		return false
+	}
+	if line = strings.TrimSpace(line); line != "" {
+		username = line
+	}
+
+	pass, err := ask_password("Safe password: ")
+	if err != nil {
+		return false
+	}
+	passwd = pass
+	add_secret(passwd)
+	return true
+}
+
+// How many redirects the safe is allowed to send us through
+var max_redirects int
+
+// A misconfigured (or malicious) safe could redirect us in a loop or off
+// to some other machine, taking the credentials with it.  So only follow
+// a few redirects, and only on the same host.
+func check_redirect(req *http.Request, via []*http.Request) error {
+	if len(via) > max_redirects {
+		return errors.New("Safe redirected us more than " + strconv.Itoa(max_redirects) + " times; see -max-redirects")
+	}
+	orig := via[0].URL
+	if req.URL.Host != orig.Host {
+		return errors.New("Refusing to follow redirect from " + orig.Host + " to a different host " + req.URL.Host)
+	}
+	if orig.Scheme == "https" && req.URL.Scheme != "https" {
+		return errors.New("Refusing to follow redirect from https to " + req.URL.Scheme)
+	}
+	return nil
+}
+
+// How many seconds to wait for the safe before giving up
+var timeout int
+
+const default_timeout = 30
+
+// Anything that can send a request to the safe for us
+type http_doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// If set, used instead of a client built from the options; e.g. so
+// the safe can be replaced with an httptest.Server
+var http_client http_doer
+
+// With -insecure the safe's certificate isn't checked at all, for safes
+// behind a proxy with a self-signed certificate
+var insecure bool
+
+// With -cacert, the certificates of a private CA the safe's certificate
+// should be signed by, instead of the system ones
+var ca_file string
+var ca_pool *x509.CertPool
+
+func load_ca_file(file string) (*x509.CertPool, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, errors.New("Could not read CA certificate " + file + ": " + err.Error())
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(data) {
+		return nil, errors.New("No PEM certificates found in " + file)
+	}
+	return pool, nil
+}
+
+func new_http_client() *http.Client {
+	client := &http.Client{
+		CheckRedirect: check_redirect,
+		Timeout:       time.Duration(timeout) * time.Second,
+	}
+	if insecure || ca_pool != nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure, RootCAs: ca_pool}
+		client.Transport = transport
+	}
+	return client
+}
+
+// Turn a failed request into something readable, without any passwords
+func request_error(prefix string, err error) error {
+	if e, ok := err.(net.Error); ok && e.Timeout() {
+		return transient_error{"The safe did not answer within " + strconv.Itoa(timeout) + " seconds; is it switched on and connected?  See -timeout"}
+	}
+	return transient_error{prefix + redact(err.Error())}
+}
+
+// Send a command to the safe and return what it said
+func safe_request(cmd string) (string, error) {
+	return safe_request_ctx(context.Background(), cmd)
+}
+
+// The same, but giving up with interrupted if ctx is cancelled
+func safe_request_ctx(ctx context.Context, cmd string) (string, error) {
+	delay := retry_delay
+	try := 0
+	for {
+		user, pass := get_credentials()
+		res, err := safe_request_as(ctx, cmd, user, pass)
+		if _, ok := err.(auth_error); ok && reauth && prompt_credentials(user, pass) {
+			continue
+		}
+		if _, ok := err.(transient_error); ok && !safe_found && next_safe() {
+			verbose_msg(err.Error() + "\nTrying the safe at " + current_safe().String())
+			continue
+		}
+		if _, ok := err.(transient_error); ok && try < retries {
+			if !safe_found {
+				use_safe(safes[0])
+			}
+			try++
+			verbose_msg(err.Error() + "\nRetrying in " + delay.String() + " (" + strconv.Itoa(try) + " of " + strconv.Itoa(retries) + ")")
+			select {
+			case <-time.After(delay):
+			case <-ctx.Done():
+				return "", interrupted
+			}
+			delay *= 2
+			continue
+		}
+		return res, err
+	}
+}
+
+func safe_request_as(ctx context.Context, cmd, user, pass string) (string, error) {
+	// However it's sent, the password is kept out of messages
+	for _, p := range strings.Split(cmd, "&") {
+		kv := strings.SplitN(p, "=", 2)
+		for _, name := range password_params {
+			if len(kv) == 2 && kv[0] == name {
+				psw, _ := url.QueryUnescape(kv[1])
+				add_password(psw)
+			}
+		}
+	}
+
+	req, err := new_safe_request(ctx, cmd)
+	if err != nil {
+		// Ensure error doesn't have any passwords in it...
+		return "", errors.New("Got error setting up http request: " + redact(err.Error()))
+	}
+
+	set_auth(req, user, pass)
+	if use_post {
+		verbose_msg(redact("Sending POST " + req.URL.String() + " with " + cmd))
+	} else {
+		verbose_msg(redact("Sending GET " + req.URL.String()))
+	}
+
+	client := http_client
+	if client == nil {
+		client = new_http_client()
+	}
+	resp, err := client.Do(req)
+	if err != nil && ctx.Err() != nil {
+		return "", interrupted
+	}
+	if err != nil {
+		return "", request_error("Problems talking to the safe: ", err)
+	}
+	if !safe_found && len(safes) > 1 {
+		verbose_msg("Using the safe at " + current_safe().String())
+	}
+	safe_found = true
+
+	// Digest needs a second go, answering the safe's challenge.  A safe
+	// that refused Basic may be asking for Digest instead, and one that
+	// refused our answer to an old challenge has sent a new one.
+	challenge, is_digest := digest_challenge(resp)
+	if resp.StatusCode == http.StatusUnauthorized &&
+		(auth_method == "digest" || (auth_method == "basic" && user != "" && is_digest)) {
+		if auth_method == "basic" && digest_last == "" {
+			verbose_msg("Safe wants Digest authentication; trying that")
+		}
+		resp.Body.Close()
+
+		req, err = new_safe_request(ctx, cmd)
+		if err != nil {
+			return "", errors.New("Got error setting up http request: " + redact(err.Error()))
+		}
+		hdr, err := digest_authorization(challenge, 1, req.Method, req.URL.RequestURI(), user, pass)
+		if err != nil {
+			return "", auth_error{err.Error()}
+		}
+		digest_last, digest_count = challenge, 1
+		req.Header.Set("Authorization", hdr)
+
+		resp, err = client.Do(req)
+		if err != nil && ctx.Err() != nil {
+			return "", interrupted
+		}
+		if err != nil {
+			return "", request_error("Problems talking to the safe: ", err)
+		}
+	}
+	defer resp.Body.Close()
+
+	// Get the response as a string
+	//   http://dlintw.github.io/gobyexample/public/http-client.html
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil && ctx.Err() != nil {
+		return "", interrupted
+	}
+	if err != nil {
+		return "", request_error("Problems getting response from safe: ", err)
+	}
+	res := string(body)
+	verbose_msg(redact("Safe said " + resp.Status + ": " + res))
+
+	if save_response != "" {
+		save_safe_response(cmd, resp.Status, res)
+	}
+
+	if resp.StatusCode == http.StatusUnauthorized {
+		return "", auth_error{"Safe rejected the username/password: " + resp.Status}
+	}
+	if resp.StatusCode >= 500 {
+		return "", transient_error{"Bad result from safe: " + resp.Status + "\n" + redact(res)}
+	}
+	if resp.StatusCode != 200 {
+		return "", errors.New("Bad result from safe: " + resp.Status + "\n" + redact(res))
+	}
+	return res, nil
+}
+
+// Keep a copy of the last thing the safe said, for debugging, with
+// passwords removed
+func save_safe_response(cmd, status, res string) {
+	data := "Command: " + redact(cmd) + "\nStatus: " + status + "\n\n" + redact(res) + "\n"
+	err := write_state_file(save_response, []byte(data), false)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "Warning: could not save safe response to "+save_response+": "+err.Error())
+	}
+}
+
+// -raw commands may only be name=value pairs, joined with &, so they
+// can't change the host or path the command goes to
+var raw_chars = regexp.MustCompile(`^[A-Za-z0-9_.%=&-]+$`)
+
+func check_raw_command(cmd string) error {
+	if !raw_chars.MatchString(cmd) {
+		return errors.New("-raw should be name=value pairs joined with &, e.g. -raw status=1; only letters, digits and _ . % - are allowed in them")
+	}
+	values, err := url.ParseQuery(cmd)
+	if err != nil {
+		return errors.New(redact("Could not understand -raw " + cmd + ": " + err.Error()))
+	}
+	if _, ok := values["lock"]; ok {
+		return errors.New("-raw will not lock the safe, as there'd be no lock image to open it with; use -lock")
+	}
+	// Keep any password out of the verbose messages
+	for _, p := range values["unlock"] {
+		add_secret(p)
+	}
+	return nil
+}
+
+// Send a command as given, and print whatever the safe says
+func raw_command(cmd string) error {
+	if err := check_raw_command(cmd); err != nil {
+		return with_code(exit_usage, err)
+	}
+	fmt.Fprintln(os.Stderr, "Warning: -raw is for experts; the command is sent as it is, with none of the usual checks")
+	res, err := safe_request(cmd)
+	if err != nil {
+		return err
+	}
+	fmt.Println(res)
+	return nil
+}
+
+//////////////////////////////////////////////////////////////////////
+//
+// Main functions
+//
+//////////////////////////////////////////////////////////////////////
+
+// With -count, how many lock images to make, all with the same password
+var lock_count int
+
+// With -duration, how long the safe should stay locked.  The firmware
+// takes whole seconds.
+var duration_flag string
+var lock_duration time.Duration
+
+// A Go duration (e.g. 72h) or a number of seconds
+func parse_lock_duration(str string) (time.Duration, error) {
+	d, err := time.ParseDuration(str)
+	if err != nil {
+		secs, serr := strconv.ParseInt(str, 10, 64)
+		if serr != nil {
+			return 0, errors.New("Bad -duration " + str + "; use e.g. 90m, 72h or a number of seconds")
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d < time.Second || d%time.Second != 0 {
+		return 0, errors.New("-duration must be a whole number of seconds, at least 1")
+	}
+	return d, nil
+}
+
+// Work out which source goes to which lock image.  -source can be a
+// comma separated list, one per image, or a single source used for all
+// of them.  With more than one image a number is added to each name,
+// e.g. lock.jpg becomes lock-1.jpg, lock-2.jpg...
+func lock_files(src, dest string) ([]string, []string, error) {
+	sources := []string{src}
+	if src != "" {
+		sources = strings.Split(src, ",")
+	}
+	count := lock_count
+	if share_count != 0 {
+		count = share_count
+	}
+	if count == 0 {
+		count = len(sources)
+	}
+	if count < 1 {
+		return nil, nil, with_code(exit_usage, errors.New("-count must be at least 1"))
+	}
+	if len(sources) != 1 && len(sources) != count {
+		return nil, nil, with_code(exit_usage, errors.New("-count is "+strconv.Itoa(count)+" but "+strconv.Itoa(len(sources))+" sources were given"))
+	}
+	if count == 1 {
+		return sources, []string{dest}, nil
+	}
+	if dest == "-" {
+		return nil, nil, with_code(exit_usage, errors.New("Only one lock image can be written to stdout"))
+	}
+
+	var srcs, dests []string
+	ext := filepath.Ext(dest)
+	for i := 1; i <= count; i++ {
+		srcs = append(srcs, sources[(i-1)%len(sources)])
+		dests = append(dests, strings.TrimSuffix(dest, ext)+"-"+strconv.Itoa(i)+ext)
+	}
+	return srcs, dests, nil
+}
+
+// One lock image being made: where it comes from and goes to, and the
+// source parsed ready for the password to go in
+type lock_target struct {
+	src, dest string
+	data      []byte
+	kind      string // jpeg, png, gif, webp, tiff, bmp or steg
+	jpeg      carrier.JPEG
+	png       PNG
+	gif       GIF
+	webp      WebP
+	tiff      TIFF
+	bmp       BMP
+
+	// Once the password is in
+	payload []byte
+	write   func(io.Writer) error
+}
+
+// Check a source can be used and parse it
+func prepare_target(src string, data []byte, dest string) (*lock_target, error) {
+	t := &lock_target{src: src, dest: dest, data: data, kind: "jpeg"}
+
+	// PNG sources keep the password in a text chunk, GIFs in a comment,
+	// WebPs in a chunk of their own, TIFFs in a private tag and BMPs
+	// after the pixels
+	if use_steg {
+		t.kind = "steg"
+		if src != "" && is_webp(data) {
+			return nil, with_code(exit_usage, errors.New("-steg can not read WebP images"))
+		}
+		if src != "" && is_tiff(data) {
+			return nil, with_code(exit_usage, errors.New("-steg can not read TIFF images"))
+		}
+		if src != "" && is_bmp(data) {
+			return nil, with_code(exit_usage, errors.New("-steg can not read BMP images"))
+		}
+	} else if src != "" && is_png(data) {
+		t.kind = "png"
+	} else if src != "" && is_gif(data) {
+		t.kind = "gif"
+	} else if src != "" && is_webp(data) {
+		t.kind = "webp"
+	} else if src != "" && is_tiff(data) {
+		t.kind = "tiff"
+	} else if src != "" && is_bmp(data) {
+		t.kind = "bmp"
+	}
+	metadata := t.kind != "jpeg" && t.kind != "steg"
+	if metadata && quality != 0 {
+		return nil, with_code(exit_usage, errors.New("-quality only applies to JPEG images"))
+	}
+	if metadata && strip_comments {
+		return nil, with_code(exit_usage, errors.New("-strip-comments only applies to JPEG images"))
+	}
+	if metadata && use_trailer {
+		return nil, with_code(exit_usage, errors.New("-trailer only applies to JPEG images"))
+	}
+	if metadata && use_xmp {
+		return nil, with_code(exit_usage, errors.New("-xmp only applies to JPEG images"))
+	}
+	if use_xmp && use_trailer {
+		return nil, with_code(exit_usage, errors.New("Use either -xmp or -trailer, not both"))
+	}
+
+	var err error
+	if placeholder != "" {
+		t.jpeg, err = make_placeholder(placeholder)
+	} else if t.kind == "png" {
+		t.png, err = parse_png(data)
+	} else if t.kind == "gif" {
+		t.gif, err = parse_gif(data)
+	} else if t.kind == "webp" {
+		t.webp, err = parse_webp(data)
+	} else if t.kind == "tiff" {
+		t.tiff, err = parse_tiff(data)
+	} else if t.kind == "bmp" {
+		t.bmp, err = parse_bmp(data)
+	} else if t.kind == "jpeg" {
+		t.jpeg, err = carrier.Parse(data)
+	}
+	if err == nil && quality != 0 {
+		verbose_msg("Re-encoding image at quality " + strconv.Itoa(quality))
+		t.jpeg, err = reencode_jpeg(t.jpeg, quality)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	// Make sure we can really write this image before the safe gets
+	// locked.  Hiding the password in the pixels checks that as it goes.
+	if verify_image && t.kind != "steg" {
+		if err := t.verify(); err != nil {
+			msg := err.Error()
+			if !strings.HasSuffix(msg, "\nThe safe has not been locked") {
+				msg += "\nThe safe has not been locked"
+			}
+			return nil, errors.New(msg)
+		}
+	}
+	return t, nil
+}
+
+// Put the payload into the image, ready for it to be written
+func (t *lock_target) embed(payload []byte) error {
+	var err error
+	t.payload = payload
+	switch t.kind {
+	case "steg":
+		var img image.Image
+		if placeholder != "" {
+			img, err = jpeg.Decode(bytes.NewReader(jpeg_bytes(t.jpeg)))
+		} else {
+			img, err = decode_any_image(t.src, t.data)
+		}
+		if err != nil {
+			return err
+		}
+		hidden, err := steg_embed(img, t.payload)
+		if err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		if p, ok := steg_extract(hidden); !ok || !bytes.Equal(p, t.payload) {
+			return errors.New("Could not read back the password hidden in the image\nThe safe has not been locked")
+		}
+		if t.dest != "-" && !strings.HasSuffix(strings.ToLower(t.dest), ".png") {
+			fmt.Fprintln(os.Stderr, "Note: "+t.dest+" will be a PNG image; the password would not survive JPEG")
+		}
+		t.write = func(w io.Writer) error { return png.Encode(w, hidden) }
+	case "png":
+		embed_png_password(&t.png, payload)
+		t.write = func(w io.Writer) error { return write_png(w, t.png) }
+	case "gif":
+		embed_gif_password(&t.gif, payload)
+		if err := check_gif_frames(t.data, t.gif); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		t.write = func(w io.Writer) error { return write_gif(w, t.gif) }
+	case "webp":
+		if err := embed_webp_password(&t.webp, payload); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		t.write = func(w io.Writer) error { return write_webp(w, t.webp) }
+	case "tiff":
+		if err := embed_tiff_password(&t.tiff, payload); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		t.write = func(w io.Writer) error { return write_tiff(w, t.tiff) }
+	case "bmp":
+		if err := embed_bmp_password(&t.bmp, payload); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		t.write = func(w io.Writer) error { return write_bmp(w, t.bmp) }
+	default:
+		if err := embed_password(&t.jpeg, payload); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+		t.write = func(w io.Writer) error { return carrier.Write(w, t.jpeg) }
+	}
+	if charset_check {
+		if err := check_payload_charset(t.payload); err != nil {
+			return errors.New(err.Error() + "\nThe safe has not been locked")
+		}
+	}
+	return nil
+}
+
+// Go through the whole embed/write/read cycle with a dummy password on a
+// copy of the target, so we know the image can be saved and read back
+func (t *lock_target) verify() error {
+	test_pswd := strings.Repeat("X", password_length)
+	check := *t
+	if err := check.embed(encode_payload(test_pswd, payload_options())); err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	if err := check.write(&buf); err != nil {
+		return errors.New("Source image can not be written with a password in it: " + err.Error())
+	}
+	return check_lock_image("the source image", buf.Bytes(), LockInfo{Password: test_pswd})
+}
+
+// Write the lock image out and make sure the password (or share) can be
+// read back
+func (t *lock_target) save(want LockInfo) error {
+	if t.dest == "-" {
+		// Check it before it goes, since we can't read stdout back
+		var buf bytes.Buffer
+		err := t.write(&buf)
+		if err == nil {
+			err = check_lock_image("the lock image", buf.Bytes(), want)
+		}
+		if err != nil {
+			return errors.New("We could not make the image: " + err.Error())
+		}
+		if _, err = os.Stdout.Write(buf.Bytes()); err != nil {
+			return errors.New("We could not write the image: " + err.Error())
+		}
+		return nil
+	}
+
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(t.dest, mode, 0666)
+	if err != nil {
+		return errors.New("We could not create the image file: " + err.Error())
+	}
+	err = t.write(f)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return errors.New("We could not write the image file: " + err.Error())
+	}
+
+	// Read it back the way -unlock will, so we know it really works
+	err = check_saved_image(t.dest, want)
+	if err != nil {
+		return errors.New(err.Error() + "\nDo not use " + t.dest)
+	}
+	return nil
+}
+
+func lock(src, dest string) error {
+	if src == "" && placeholder == "" {
+		return with_code(exit_usage, errors.New("Missing --source file"))
+	}
+
+	if src != "" && placeholder != "" {
+		return with_code(exit_usage, errors.New("Use either -source or -placeholder, not both"))
+	}
+
+	sources, dests, err := lock_files(src, dest)
+	if err != nil {
+		return err
+	}
+	for _, s := range sources {
+		for _, d := range dests {
+			if s == d && d != "-" {
+				return with_code(exit_usage, errors.New("Source and destination names can not be the same"))
+			}
+		}
+	}
+
+	// When the image goes to stdout our messages mustn't
+	out := io.Writer(os.Stdout)
+	if dest == "-" {
+		out = os.Stderr
+	}
+
+	// Overwriting an old lock image could lose the only copy of a
+	// password, so find out now rather than after locking the safe
+	for _, d := range dests {
+		if _, err := os.Lstat(d); err == nil && d != "-" && !force {
+			return with_code(exit_usage, errors.New(d+" already exists; use -force to overwrite it"))
+		}
+	}
+	if show_password && dest == "-" {
+		return with_code(exit_usage, errors.New("-show-password can not be used when the lock image goes to stdout"))
+	}
+	if keyfile != "" {
+		if _, err := os.Lstat(keyfile); err == nil && !force {
+			return with_code(exit_usage, errors.New(keyfile+" already exists; use -force to overwrite it"))
+		}
+	}
+
+	if quality != 0 && (quality < 1 || quality > 100) {
+		return with_code(exit_usage, errors.New("-quality should be between 1 and 100"))
+	}
+
+	if quality != 0 && use_steg {
+		return with_code(exit_usage, errors.New("-quality can not be used with -steg; the image is written as PNG"))
+	}
+
+	// Each source is only read once, so stdin can be used for all of them
+	read := make(map[string][]byte)
+	var targets []*lock_target
+	for i, s := range sources {
+		data, ok := read[s]
+		if !ok && s != "" {
+			data, err = read_file(s)
+			if err != nil {
+				return with_code(exit_image, err)
+			}
+			read[s] = data
+		}
+		if i == 0 {
+			info_msg(out, "Creating a new lock")
+		}
+		t, err := prepare_target(s, data, dests[i])
+		if err != nil {
+			return with_code(exit_image, err)
+		}
+		targets = append(targets, t)
+	}
+
+	// Generate a random password, unless one was chosen
+	new_pswd := set_password
+	if new_pswd == "" {
+		verbose_msg("Password length " + strconv.Itoa(password_length))
+		new_pswd, err = generate_password()
+		if err != nil {
+			return err
+		}
+	}
+	add_secret(new_pswd)
+	// DEBUG
+	// new_pswd = "hello"
+
+	// Now embed the password (or its shares) in the images
+	payloads, want, err := lock_payloads(new_pswd, len(targets))
+	if err != nil {
+		return err
+	}
+	for i, t := range targets {
+		if err := t.embed(payloads[i]); err != nil {
+			return with_code(exit_image, err)
+		}
+	}
+
+	// Ctrl-C before the safe is locked just stops.  Once the lock command
+	// has gone, requests are left to finish (they time out anyway) so we
+	// always know what state the safe is in, and an interrupt then is
+	// handled like any other failure: unlock the safe, or say what the
+	// password is
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Locking again would replace the password in the last lock image,
+	// and that image may be the only copy of it
+	res, err := safe_request_ctx(ctx, "status=1")
+	if err != nil {
+		return err
+	}
+	var stop_err error
+	if rekey_from != "" {
+		if st, err := parse_status(res); err == nil && !st.Locked {
+			return with_code(exit_usage, errors.New("The safe is not locked, so there is no password to change; use -lock"))
+		}
+	} else if !relock {
+		st, err := parse_status(res)
+		if err != nil {
+			stop_err = with_code(exit_safe, errors.New(err.Error()+"\nCan not tell if the safe is already locked; use -relock to lock it anyway"))
+		} else if st.Locked {
+			stop_err = with_code(exit_safe, errors.New("The safe is already locked; unlock it first, or use -relock to replace its password"))
+		}
+	}
+	// A dry run says so, and carries on with everything else
+	if stop_err != nil && !dry_run {
+		return stop_err
+	}
+
+	// Everything's ready, but don't touch the safe or the file system
+	if dry_run {
+		var sizes []string
+		for _, t := range targets {
+			var buf bytes.Buffer
+			if err := t.write(&buf); err != nil {
+				return with_code(exit_image, errors.New("Could not build the lock image: "+err.Error()))
+			}
+			sizes = append(sizes, strconv.Itoa(buf.Len())+" bytes to "+t.dest)
+		}
+		fmt.Fprintln(out, "Safe "+safe+" answered: "+res)
+		what := "lock the safe"
+		if rekey_from != "" {
+			what = "unlock the safe with the password in " + rekey_image + " and lock it again"
+		}
+		fmt.Fprintln(out, "Dry run: would "+what+" with a "+strconv.Itoa(len(new_pswd))+" character password and write "+strings.Join(sizes, ", "))
+		if stop_err != nil {
+			fmt.Fprintln(out, "But a real lock would not go ahead: "+stop_err.Error())
+		}
+		return nil
+	}
+
+	// Until the image is saved this is the only copy of the password, so
+	// keep it somewhere safe in case we can't write the image and then
+	// can't unlock either
+	recovery, err := write_recovery(dests[0], new_pswd)
+	if err != nil {
+		return errors.New(err.Error() + "\nThe safe has not been locked")
+	}
+	verbose_msg("Password saved in " + recovery + " until the image is written")
+	if ctx.Err() != nil {
+		os.Remove(recovery)
+		return interrupted
+	}
+
+	// The safe can't change its password while locked, so -rekey unlocks
+	// it with the old one first.  If the new lock can't be made after
+	// that, the safe is locked again with the old password.
+	lock_command := func(q string) string {
+		cmd := "lock=1&lock1=" + q + "&lock2=" + q
+		if lock_duration != 0 {
+			cmd += "&duration=" + strconv.FormatInt(int64(lock_duration/time.Second), 10)
+		}
+		return cmd
+	}
+	old_q := url.QueryEscape(rekey_from)
+	relock_old := func() string {
+		res, err := safe_request(lock_command(old_q))
+		if err == nil && res == "Safe locked" {
+			res, err = safe_request("pwtest=1&unlock=" + old_q)
+			if err == nil && res == "Passwords match" {
+				return "\nThe safe has been locked again with the password in " + rekey_image
+			}
+		}
+		if err != nil {
+			res = err.Error()
+		}
+		return "\nThe safe has been left unlocked: we could not lock it again with the password in " + rekey_image + ": " + res
+	}
+	if rekey_from != "" {
+		res, err := safe_request("unlock_all=1&unlock=" + old_q)
+		if err == nil && !strings.Contains(strings.ToLower(res), "unlocked") {
+			err = with_code(exit_verify, errors.New("The safe did not unlock with the password in "+rekey_image+": "+res))
+		}
+		if err != nil {
+			os.Remove(recovery)
+			if _, ok := err.(transient_error); ok {
+				return with_code(exit_safe, errors.New(err.Error()+"\nThe safe may have been unlocked; the password in "+rekey_image+" will lock it again"))
+			}
+			return err
+		}
+		verbose_msg("Unlocked with the password in " + rekey_image)
+		if ctx.Err() != nil {
+			os.Remove(recovery)
+			return with_code(exit_interrupted, errors.New("Interrupted"+relock_old()))
+		}
+	}
+
+	// Lock the safe
+	q := url.QueryEscape(new_pswd)
+	res, err = safe_request(lock_command(q))
+	if err == nil && res != "Safe locked" {
+		if lock_duration != 0 {
+			res += "\nThe safe may not take -duration, or not for " + human_duration(lock_duration)
+		}
+		err = with_code(exit_safe, errors.New("Problem locking safe: "+res))
+	}
+	if err != nil {
+		// We can't be sure it didn't lock if we didn't get an answer
+		if _, ok := err.(transient_error); ok {
+			msg := "\nThe safe may have been locked; the password is in " + recovery
+			if rekey_from != "" {
+				msg += "\nor it may still be unlocked"
+			}
+			return with_code(exit_safe, errors.New(err.Error()+msg))
+		}
+		os.Remove(recovery)
+		if rekey_from != "" {
+			return with_code(exit_code(err), errors.New(err.Error()+relock_old()))
+		}
+		return err
+	}
+
+	// Something went wrong after locking; try to put things back
+	wrote_keyfile := false
+	fail := func(code int, msg string) error {
+		res, err := safe_request("unlock_all=1&unlock=" + q)
+		if err == nil && strings.Contains(strings.ToLower(res), "unlocked") {
+			os.Remove(recovery)
+			if wrote_keyfile {
+				os.Remove(keyfile)
+			}
+			if rekey_from != "" {
+				return with_code(code, errors.New(msg+relock_old()))
+			}
+			return with_code(code, errors.New(msg+"\nThe safe has been unlocked again"))
+		}
+		if err != nil {
+			res = err.Error()
+		}
+		return with_code(code, errors.New(msg+"\nWe could not unlock the safe either: "+res+"\nThe password generated was\n  "+new_pswd+"\nand is saved in "+recovery))
+	}
+
+	// Check the password was accepted.  A busy safe may not answer
+	// properly first time, so give it a few goes before giving up
+	for try := 0; ; try++ {
+		if ctx.Err() != nil {
+			return fail(exit_interrupted, "Interrupted")
+		}
+		res, err = safe_request("pwtest=1&unlock=" + q)
+		if err == nil && res == "Passwords match" {
+			break
+		}
+		if try >= verify_retries {
+			if err != nil {
+				res = err.Error()
+			}
+			return fail(exit_verify, "Unable to verify lock worked: "+res)
+		}
+		verbose_msg("Verification attempt " + strconv.Itoa(try+1) + " failed, retrying")
+		select {
+		case <-time.After(verify_delay):
+		case <-ctx.Done():
+		}
+	}
+
+	// The safe has the password, so now it's worth backing up
+	if keyfile != "" {
+		if err := write_keyfile(keyfile, new_pswd); err != nil {
+			return fail(exit_verify, "Could not write the -keyfile: "+err.Error())
+		}
+		wrote_keyfile = true
+		fmt.Fprintln(os.Stderr, "WARNING: the safe's password is in "+keyfile+" in cleartext.\nAnyone who can read that file can unlock the safe; keep it somewhere safe.")
+	}
+
+	// Save the new images
+	for i, t := range targets {
+		if ctx.Err() != nil {
+			return fail(exit_interrupted, "Interrupted")
+		}
+		if err := t.save(want[i]); err != nil {
+			return fail(exit_verify, err.Error())
+		}
+	}
+	os.Remove(recovery)
+	for _, t := range targets {
+		if t.dest == "-" {
+			info_msg(out, "Lock image written to stdout.")
+		} else {
+			info_msg(out, t.dest+" created.")
+		}
+	}
+	if show_password {
+		fmt.Fprintln(os.Stderr, "WARNING: the safe's password is shown below; anyone who sees it can unlock the safe.")
+		fmt.Println(new_pswd)
+	}
+	// A chosen password was warned about before locking
+	if set_password == "" {
+		bits := password_entropy(password_length, len(charset))
+		verbose_msg("Password entropy is " + strconv.FormatFloat(bits, 'f', 1, 64) + " bits (" + strconv.Itoa(password_length) + " characters from a set of " + strconv.Itoa(len(charset)) + ")")
+		if bits < min_entropy_bits {
+			fmt.Fprintln(os.Stderr, "Warning: the password has only "+strconv.FormatFloat(bits, 'f', 1, 64)+" bits of entropy; use a longer -length or bigger -charset")
+		}
+	}
+	for _, t := range targets {
+		run_hook(on_lock, "lock", t.dest, "Safe locked")
+	}
+	return nil
+}
+
+func check_saved_image(file string, want LockInfo) error {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return errors.New("Could not read back " + file + ": " + err.Error())
+	}
+	return check_lock_image(file, data, want)
+}
+
+func check_lock_image(file string, data []byte, want LockInfo) error {
+	info, _, err := read_lock_info(data)
+	if err != nil {
+		return errors.New("Could not find the password in " + file + ": " + err.Error())
+	}
+	if info.Password != want.Password || info.Share != want.Share {
+		return errors.New("The password in " + file + " is not the one the safe was locked with")
+	}
+	return nil
+}
+
+// What's in the recovery file or -keyfile
+func password_file_text(kind, psw string) string {
+	return "picture_lock " + kind + "\n" +
+		"The safe " + safe + " was locked at " + time.Now().Format(time.RFC1123) + " with the password\n" +
+		psw + "\n"
+}
+
+// Save the password next to where the image will go or, if that can't
+// be written, in the home directory
+func write_recovery(dest, psw string) (string, error) {
+	data := password_file_text("recovery file", psw)
+	files := []string{dest + ".recovery", UserHomeDir() + "picture_lock.recovery"}
+	if dest == "-" {
+		files = files[1:]
+	}
+	for _, file := range files {
+		f, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+		if err != nil {
+			continue
+		}
+		f.Chmod(0600)
+		_, err = f.WriteString(data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			return file, nil
+		}
+		os.Remove(file)
+	}
+	return "", errors.New("Could not write a recovery file for the password")
+}
+
+// The -keyfile backup, only readable by the user
+func write_keyfile(file, psw string) error {
+	mode := os.O_WRONLY | os.O_CREATE | os.O_EXCL
+	if force {
+		mode = os.O_WRONLY | os.O_CREATE | os.O_TRUNC
+	}
+	f, err := os.OpenFile(file, mode, 0600)
+	if err != nil {
+		return err
+	}
+	f.Chmod(0600)
+	_, err = f.WriteString(password_file_text("key file", psw))
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file)
+	}
+	return err
+}
+
+// Find the password (or share) in an image, and check it can be trusted
+func trusted_lock_info(data []byte) (LockInfo, error) {
+	info, where, err := read_lock_info(data)
+	if err != nil {
+		return info, err
+	}
+	verbose_msg("Password found in " + where)
+	if info.Created != "" {
+		verbose_msg("Locked at " + info.Created)
+	}
+	if info.Duration != 0 {
+		verbose_msg("Locked for " + human_duration(time.Duration(info.Duration)*time.Second))
+	}
+	if info.Safe != "" {
+		verbose_msg("Locked on safe " + info.Safe)
+	}
+	if err := check_signature(info, sign_key); err != nil {
+		if !force {
+			return info, errors.New(err.Error() + "\nUse -force to use it anyway")
+		}
+		fmt.Fprintln(os.Stderr, "Warning: "+err.Error())
+	}
+	check_age(info)
+	return info, nil
+}
+
+// Use the password in an image to unlock (or just test) the safe,
+// returning what the safe said
+func unlock_image(name string, data []byte, tst bool) (string, error) {
+	info, err := trusted_lock_info(data)
+	if err != nil {
+		return "", with_code(exit_image, err)
+	}
+	if info.Share != "" {
+		return "", with_code(exit_usage, errors.New(name+" holds "+describe_share(info)+"; give at least "+strconv.Itoa(info.Threshold)+" of the share images together"))
+	}
+	psw := info.Password
+	add_secret(psw)
+	return send_unlock(name, psw, tst)
+}
+
+// With -unlock-one, release just one lock rather than all of them
+var unlock_one bool
+
+// -unlock from the command line asks first, unless -yes is given
+var ask_unlock, assume_yes bool
+
+// Ask the safe to unlock (or just test) with this password
+func send_unlock(name, psw string, tst bool) (string, error) {
+	cmd := "unlock_all"
+	if tst {
+		cmd = "pwtest"
+	} else if unlock_one {
+		cmd = "unlock_one"
+	}
+
+	if !tst && ask_unlock && !assume_yes {
+		if !term.IsTerminal(int(os.Stdin.Fd())) {
+			return "", with_code(exit_usage, errors.New("Not unlocking without asking first; use -yes when there's no terminal to ask on"))
+		}
+		if !confirm("Are you sure you want to unlock the safe?") {
+			return "", errors.New("The safe has not been unlocked")
+		}
+	}
+
+	res, err := safe_request(cmd + "=1&unlock=" + url.QueryEscape(psw))
+	if err == nil && !tst {
+		run_hook(on_unlock, "unlock", name, res)
+	}
+	return res, err
+}
+
+// What the safe said is the answer to -test, but with -quiet an unlock
+// that worked needs no comment.  A -test the password failed gives an
+// error, for the exit code.
+func report_unlock(res string, tst bool) error {
+	if !tst {
+		info_msg(os.Stdout, res)
+		return nil
+	}
+	fmt.Println(res)
+	if res != "Passwords match" {
+		return with_code(exit_verify, errors.New("The safe did not accept the password"))
+	}
+	return nil
+}
+
+func unlock(file string, tst bool) error {
+	data, err := read_file(file)
+	if err != nil {
+		return with_code(exit_image, err)
+	}
+
+	res, err := unlock_image(file, data, tst)
+	if err != nil {
+		return err
+	}
+	return report_unlock(res, tst)
+}
+
+// Change the password of a locked safe: the password in the old image
+// unlocks it and it's locked again with a new one, just as with -lock.
+// Without -source the old image is the source of the new one.
+func rekey(src string, args []string) error {
+	if len(args) != 2 {
+		return with_code(exit_usage, errors.New("-rekey needs the old lock image and then the new one, e.g. -rekey old.jpg new.jpg"))
+	}
+	old, dest := args[0], args[1]
+	if old == dest {
+		return with_code(exit_usage, errors.New("The new lock image can not replace the old one; the old one is needed if anything goes wrong"))
+	}
+	// main() has already checked it, but the safe mustn't be left
+	// locked with a password the image can't give back
+	if set_password != "" {
+		if err := check_chosen_password(set_password); err != nil {
+			return with_code(exit_usage, err)
+		}
+	}
+	if src == "" && placeholder == "" {
+		if old == "-" {
+			return with_code(exit_usage, errors.New("Give a -source when the old lock image is read from stdin"))
+		}
+		src = old
+	}
+
+	data, err := read_file(old)
+	if err != nil {
+		return with_code(exit_image, err)
+	}
+	info, err := trusted_lock_info(data)
+	if err != nil {
+		return with_code(exit_image, err)
+	}
+	if info.Share != "" {
+		return with_code(exit_usage, errors.New(old+" holds "+describe_share(info)+"; -rekey needs an image with the whole password"))
+	}
+	add_secret(info.Password)
+
+	// Make sure it really is the safe's password before going any further
+	res, err := safe_request("pwtest=1&unlock=" + url.QueryEscape(info.Password))
+	if err != nil {
+		return err
+	}
+	if res != "Passwords match" {
+		return with_code(exit_verify, errors.New("The safe does not take the password in "+old+": "+res+"\nNothing has been changed"))
+	}
+
+	// Relocking shouldn't shorten the lock or lift its time limit, so
+	// unless there's a new -duration keep what's left of the old one
+	if lock_duration == 0 {
+		lock_duration = rekey_duration(info)
+		if lock_duration != 0 {
+			verbose_msg("Keeping the rest of the lock: " + human_duration(lock_duration))
+		}
+	}
+
+	rekey_from, rekey_image = info.Password, old
+	return lock(src, dest)
+}
+
+// How long is left of the lock made with this image.  The safe knows
+// best, if it says; otherwise work it out from when the image was made
+// and the -duration it was made with.
+func rekey_duration(info LockInfo) time.Duration {
+	if res, err := safe_request("status=1"); err == nil {
+		if left, locked := lock_remaining(res); locked && left > 0 {
+			return left
+		}
+	}
+	if info.Duration == 0 {
+		return 0
+	}
+	created, err := time.Parse(time.RFC3339, info.Created)
+	if err != nil {
+		return time.Duration(info.Duration) * time.Second
+	}
+	left := time.Until(created.Add(time.Duration(info.Duration) * time.Second)).Round(time.Second)
+	if left < time.Second {
+		return 0
+	}
+	return left
+}
+
+// Show what safes are in the config file, without giving away passwords
+func list_profiles() {
+	if len(configuration.Profiles) == 0 {
+		fmt.Println("No profiles configured")
+		return
+	}
+
+	names := make([]string, 0, len(configuration.Profiles))
+	for name := range configuration.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		p := configuration.Profiles[name]
+		line := name + ": " + p.Safe
+		if p.User != "" {
+			line += " user=" + p.User
+		}
+		if p.Pass != "" {
+			line += " pass=********"
+		} else if p.PassFile != "" {
+			line += " passfile=" + p.PassFile
+		}
+		fmt.Println(line)
+	}
+}
+
+// The image file name is the one and only argument
+func get_filename() (string, error) {
+	args := flag.Args()
+
+	if len(args) == 0 {
+		return "", errors.New("Missing filename; use the -h option for help")
+	} else if len(args) != 1 {
+		return "", errors.New("Only one filename is allowed and must be the last value;\n  use the \"-h\" option for help")
+	}
+
+	return args[0], nil
+}
+
+func main() {
+	config_file := flag.String("config", "", "Config file to use (default $HOME/.picture_lock)")
+	no_config := flag.Bool("no-config", false, "Don't read any config file; use only the command line")
+	strict := flag.Bool("strict", false, "Refuse to use a config file other people can read")
+	profile := flag.String("profile", "", "Use this named safe profile from the config file")
+	flag.StringVar(&username, "user", "", "Username to talk to safe (optional)")
+	flag.StringVar(&passwd, "pass", "", "Password to talk to safe (optional)")
+	pass_stdin := flag.Bool("pass-stdin", false, "Read the password to talk to the safe from stdin")
+	flag.StringVar(&set_password, "set-password", "", "With -lock or -rekey, use this password rather than a random one; - asks for it")
+	flag.BoolVar(&show_password, "show-password", false, "With -lock, print the new password (needs -i-understand, or says yes when asked)")
+	understand := flag.Bool("i-understand", false, "With -show-password, don't ask before showing the password")
+	flag.StringVar(&safe, "safe", "", "Safe Address")
+	flag.StringVar(&auth_method, "auth", "", "How to authenticate to the safe: basic, digest or bearer (default basic)")
+	flag.StringVar(&token, "token", "", "Token for -auth bearer")
+	flag.StringVar(&on_lock, "on-lock", "", "Command to run after the safe is locked")
+	flag.StringVar(&on_unlock, "on-unlock", "", "Command to run after the safe is unlocked")
+	flag.BoolVar(&reauth, "reauth", false, "If the safe rejects our credentials, ask for new ones")
+	flag.StringVar(&serve_addr, "serve", "", "Run a local HTTP API on this address (e.g. :8080)")
+	flag.StringVar(&serve_user, "serve-user", "", "Username clients must give to the -serve API")
+	flag.StringVar(&serve_pass, "serve-pass", "", "Password clients must give to the -serve API")
+	flag.IntVar(&retries, "retries", 2, "How many times to retry after a network or server error")
+	flag.DurationVar(&retry_delay, "retry-delay", time.Second, "How long to wait before the first retry; doubles each time")
+	flag.IntVar(&timeout, "timeout", 0, "Seconds to wait for the safe to answer (default "+strconv.Itoa(default_timeout)+")")
+	flag.IntVar(&max_redirects, "max-redirects", 3, "Most redirects to follow from the safe (same host only)")
+	flag.StringVar(&lock_dir, "lock-dir", "", "Directory for the files that stop two copies using a safe at once")
+	flag.DurationVar(&lock_wait, "wait", 0, "If another copy is using the safe, wait this long for it (e.g. 5m) rather than stop")
+	flag.StringVar(&logfile, "logfile", "", "Append a line to this file for every lock, unlock and test (passwords removed)")
+	flag.StringVar(&save_response, "save-response", "", "Save the last response from the safe to this file (passwords removed)")
+	flag.BoolVar(&use_post, "post", false, "Send commands to the safe as POST, keeping passwords out of the URL")
+	flag.StringVar(&scheme, "scheme", "", "Talk to the safe with http or https (default http)")
+	flag.StringVar(&url_template, "url-template", "", "How to build safe URLs (default "+default_url_template+")")
+	flag.StringVar(&ca_file, "cacert", "", "PEM file of the CA that signed the safe's HTTPS certificate")
+	flag.BoolVar(&insecure, "insecure", false, "Don't check the safe's HTTPS certificate (e.g. if it is self-signed)")
+	flag.StringVar(&base_path, "base-path", "", "Path to the safe's commands (default "+default_base_path+")")
+	flag.StringVar(&user_agent, "user-agent", "", "User-Agent to send to the safe (default picture_lock/"+version+")")
+
+	source := flag.String("source", "", "Source Image (needed for -lock)")
+	lockflag := flag.Bool("lock", false, "Lock the safe, create new image")
+	rekeyflag := flag.Bool("rekey", false, "Change the password of a locked safe; give the old lock image, then the new one")
+	unlockflag := flag.Bool("unlock", false, "Unlock the safe with image")
+	flag.BoolVar(&assume_yes, "yes", false, "Don't ask before unlocking")
+	flag.BoolVar(&unlock_one, "unlock-one", false, "Like -unlock, but only release one lock on a safe with several")
+	testflag := flag.Bool("test", false, "Test the image can unlock the safe")
+	statusflag := flag.Bool("status", false, "Request current safe status")
+	checkflag := flag.Bool("check", false, "Check the safe can be reached and accepts the credentials, without locking or unlocking")
+	rawflag := flag.String("raw", "", "Send this command (e.g. status=1) to the safe as it is, and print the answer; for experts")
+	flag.BoolVar(&json_output, "json", false, "Print -status as JSON, and any error too")
+	flag.StringVar(&snapshot_file, "snapshot", "", "With -status, save the status to this file")
+	flag.StringVar(&diff_file, "diff", "", "With -status, report changes since the status saved in this file")
+	listflag := flag.Bool("list-profiles", false, "List the safe profiles in the config file")
+	genflag := flag.Bool("gen", false, "Just print a new random password")
+	storesflag := flag.Bool("test-all-stores", false, "Report every password stored in the image, without talking to the safe")
+	inspectflag := flag.Bool("inspect", false, "List a JPEG's segments and which hold a password, without showing it")
+	flag.IntVar(&password_length, "length", 0, "Length of generated passwords, "+strconv.Itoa(min_password_length)+" to "+strconv.Itoa(max_password_length)+" (default "+strconv.Itoa(default_password_length)+")")
+	flag.IntVar(&lock_count, "count", 0, "With -lock, how many lock images to make with the same password")
+	flag.StringVar(&duration_flag, "duration", "", "With -lock, how long the safe stays locked (e.g. 72h, or seconds)")
+	flag.IntVar(&share_count, "shares", 0, "With -lock, split the password between this many lock images")
+	flag.IntVar(&share_threshold, "threshold", 0, "With -shares, how many of the images are needed to unlock (default all of them)")
+	flag.StringVar(&charset_flag, "charset", "", "Characters for generated passwords: alnum, no-ambiguous, full, or a list of characters (default alnum)")
+	flag.IntVar(&verify_retries, "verify-retries", 3, "How many times to retry checking a new lock")
+	flag.DurationVar(&verify_delay, "verify-delay", 2*time.Second, "How long to wait between lock checks")
+	flag.IntVar(&quality, "quality", 0, "Re-encode the source image at this JPEG quality (1-100) before locking")
+	flag.StringVar(&placeholder, "placeholder", "", "Lock with a generated plain image instead of -source (e.g. \"640x480 blue\")")
+	flag.BoolVar(&verify_image, "verify-image-is-lockable", false, "Check the source image can hold a password before locking")
+	flag.StringVar(&search_order, "search-order", "comment,trailer,xmp", "Where to look for the password, in order")
+	flag.DurationVar(&max_age, "max-age", 0, "Warn if the lock image is older than this (e.g. 720h)")
+	flag.BoolVar(&verbose, "verbose", false, "Report more details of what is happening")
+	flag.BoolVar(&quiet, "quiet", false, "Only report errors, and anything asked for (e.g. -status, -gen)")
+	flag.StringVar(&sign_key, "sign", "", "Secret used to sign the embedded data, and check it on unlock")
+	flag.BoolVar(&dry_run, "dry-run", false, "With -lock, check everything but don't lock the safe or write the image")
+	flag.StringVar(&keyfile, "keyfile", "", "With -lock, also save the password in this file, in cleartext")
+	flag.BoolVar(&relock, "relock", false, "With -lock, lock the safe even if it is already locked, replacing its password")
+	flag.BoolVar(&force, "force", false, "Carry on even if the image fails its checks, and let -lock overwrite an existing file")
+	flag.StringVar(&checksum_algo, "checksum-algo", "sha256", "Checksum to store with the password: crc32, sha256, blake2b or none")
+	flag.BoolVar(&charset_check, "comment-charset-check", false, "Refuse to lock if the embedded data is not plain ASCII")
+	flag.BoolVar(&use_steg, "steg", false, "Hide the password in the image pixels; the lock image is saved as PNG")
+	flag.BoolVar(&use_steg, "stego", false, "Same as -steg")
+	flag.BoolVar(&use_trailer, "trailer", false, "Store the password after the end of the image instead of in the comment")
+	flag.BoolVar(&strip_comments, "strip-comments", false, "Remove the source JPEG's own comments, rather than keep them, when locking")
+	flag.BoolVar(&use_xmp, "xmp", false, "Store the password in the JPEG's XMP metadata instead of the comment")
+	versionflag := flag.Bool("version", false, "Print the version and exit")
+	completionflag := flag.String("completion", "", "Print a completion script for this shell (bash, zsh or fish) and exit")
+
+	flag.Parse()
+	if *versionflag {
+		fmt.Println(version_string())
+		return
+	}
+	if *completionflag != "" {
+		script, err := completion_script(*completionflag)
+		if err != nil {
+			abort(exit_usage, err.Error())
+		}
+		fmt.Print(script)
+		return
+	}
+	passflag_set := passwd != ""
+
+	// Try and find the config file.  One given with -config has to be
+	// there; the default one is optional.  Values from the command line
+	// are still used over anything in the file.
+	var config_info os.FileInfo
+	var err error
+	if *no_config {
+		if *config_file != "" || *profile != "" {
+			abort(exit_usage, "-no-config can't be used with -config or -profile")
+		}
+		verbose_msg("Not using any configuration file")
+	} else if *config_file == "" {
+		*config_file = UserHomeDir() + ".picture_lock"
+		if config_info, err = os.Stat(*config_file); err != nil {
+			*config_file = ""
+		}
+	} else if config_info, err = os.Stat(*config_file); err != nil {
+		abort(exit_config, "Could not read config file "+*config_file+": "+err.Error())
+	}
+	if *config_file != "" {
+		verbose_msg("Using configuration file " + *config_file)
+		if err := check_config_permissions(*config_file, config_info); err != nil {
+			if *strict {
+				abort(exit_config, err.Error())
+			}
+			fmt.Fprintln(os.Stderr, "Warning: "+err.Error())
+		}
+
+		parse := read_config(*config_file)
+		if parse != nil {
+			abort(exit_config, "Error parsing "+*config_file+": "+parse.Error())
+		}
+	}
+
+	if *profile != "" {
+		p, ok := configuration.Profiles[*profile]
+		if !ok {
+			abort(exit_config, "No profile called "+*profile+" in the config file; see -list-profiles")
+		}
+		verbose_msg("Using profile " + *profile)
+		configuration.Safe = p.Safe
+		configuration.User = p.User
+		configuration.Pass = p.Pass
+		configuration.PassFile = p.PassFile
+	}
+
+	if *listflag {
+		list_profiles()
+		os.Exit(0)
+	}
+
+	if err := check_search_order(); err != nil {
+		abort(exit_usage, err.Error())
+	}
+
+	if err := check_share_options(); err != nil {
+		abort(exit_usage, err.Error())
+	}
+
+	if checksum_algo != "none" {
+		if _, err := make_checksum(checksum_algo, ""); err != nil {
+			abort(exit_usage, err.Error())
+		}
+	}
+
+	// If the user didn't define these three things, use values from
+	// the environment and then the config file
+	if username == "" {
+		username = os.Getenv("PICTURE_LOCK_USER")
+	}
+	if username == "" {
+		username = configuration.User
+	}
+
+	if passwd == "" {
+		passwd = os.Getenv("PICTURE_LOCK_PASS")
+	}
+	if passwd == "" {
+		passwd = configuration.Pass
+	}
+	if passwd == "" && configuration.PassFile != "" && !*pass_stdin {
+		passwd, err = read_pass_file(configuration.PassFile)
+		if err != nil {
+			abort(exit_config, err.Error())
+		}
+	}
+
+	if safe == "" {
+		safe = os.Getenv("PICTURE_LOCK_SAFE")
+	}
+	if safe == "" {
+		safe = configuration.Safe
+	}
+	if safe == "" {
+		safe = strings.Join(configuration.Safes, ",")
+	}
+
+	if url_template == "" {
+		url_template = configuration.URLTemplate
+	}
+	if url_template == "" {
+		url_template = default_url_template
+	}
+
+	if user_agent == "" {
+		user_agent = configuration.UserAgent
+	}
+	if user_agent == "" {
+		user_agent = "picture_lock/" + version
+	}
+
+	if !use_post {
+		use_post = configuration.Post
+	}
+	if use_post && strings.Contains(url_template, "{password}") {
+		abort(exit_usage, "-post can not be used with a URL template that puts the password in the URL")
+	}
+
+	if auth_method == "" {
+		auth_method = configuration.Auth
+	}
+	if auth_method == "" {
+		auth_method = "basic"
+	}
+
+	if token == "" {
+		token = configuration.Token
+	}
+
+	if sign_key == "" {
+		sign_key = configuration.SignKey
+	}
+	add_secret(sign_key)
+
+	if timeout == 0 {
+		timeout = configuration.Timeout
+	}
+	if timeout == 0 {
+		timeout = default_timeout
+	}
+	if timeout < 0 {
+		abort(exit_usage, "-timeout must be a positive number of seconds")
+	}
+
+	if password_length == 0 {
+		password_length = configuration.Length
+	}
+	if password_length == 0 {
+		password_length = default_password_length
+	}
+	if password_length < min_password_length || password_length > max_password_length {
+		abort(exit_usage, "Password length must be between "+strconv.Itoa(min_password_length)+" and "+strconv.Itoa(max_password_length))
+	}
+
+	if charset_flag == "" {
+		charset_flag = configuration.Charset
+	}
+	charset, err = resolve_charset(charset_flag)
+	if err != nil {
+		abort(exit_usage, err.Error())
+	}
+
+	if duration_flag != "" {
+		lock_duration, err = parse_lock_duration(duration_flag)
+		if err != nil {
+			abort(exit_usage, err.Error())
+		}
+	}
+
+	if on_lock == "" {
+		on_lock = configuration.OnLock
+	}
+	if on_unlock == "" {
+		on_unlock = configuration.OnUnlock
+	}
+	if logfile == "" {
+		logfile = configuration.LogFile
+	}
+	if lock_dir == "" {
+		lock_dir = configuration.LockDir
+	}
+
+	add_secret(passwd)
+	add_secret(token)
+
+	if err := check_auth_method(); err != nil {
+		abort(exit_usage, err.Error())
+	}
+
+	if *genflag {
+		stage = "gen"
+		psw, err := generate_password()
+		if err != nil {
+			abort(exit_failure, err.Error())
+		}
+		fmt.Println(psw)
+		os.Exit(0)
+	}
+
+	// These only look at the image, so don't need a safe
+	if *storesflag {
+		stage = "test-all-stores"
+		filename, err := get_filename()
+		if err != nil {
+			abort(exit_usage, err.Error())
+		}
+		if err := test_all_stores(filename); err != nil {
+			abort(exit_image, err.Error())
+		}
+		os.Exit(0)
+	}
+	if *inspectflag {
+		stage = "inspect"
+		filename, err := get_filename()
+		if err != nil {
+			abort(exit_usage, err.Error())
+		}
+		if err := inspect_image(filename); err != nil {
+			abort(exit_image, err.Error())
+		}
+		os.Exit(0)
+	}
+
+	// Safe better be defined!
+	if safe == "" {
+		abort(exit_usage, "No safe name passed")
+	}
+
+	// Rather than have the password on the command line where others
+	// can see it, read it from stdin or ask for it
+	if *pass_stdin {
+		if passflag_set {
+			abort(exit_usage, "Use either -pass or -pass-stdin, not both")
+		}
+		if *source == "-" || (!*lockflag && flag.Arg(0) == "-") {
+			abort(exit_usage, "-pass-stdin can not be used when the image is read from stdin")
+		}
+		passwd, err = read_password_stdin()
+		if err != nil {
+			abort(exit_failure, err.Error())
+		}
+		add_secret(passwd)
+	} else if username != "" && passwd == "" && term.IsTerminal(int(os.Stdin.Fd())) {
+		passwd, err = ask_password("Safe password for " + username + ": ")
+		if err != nil {
+			abort(exit_failure, err.Error())
+		}
+		add_secret(passwd)
+	}
+
+	// Showing the password defeats the point of the lock image, so make
+	// sure it's wanted before the safe is locked
+	if show_password && !*understand {
+		if !term.IsTerminal(int(os.Stdin.Fd())) || *pass_stdin || *source == "-" {
+			abort(exit_usage, "-show-password needs -i-understand when not asked on a terminal")
+		}
+		if !confirm("The new password will be shown on the screen.  Anyone who sees it can unlock the safe.  Continue?") {
+			abort(exit_failure, "Stopped; the safe has not been locked")
+		}
+	}
+	// A chosen password is checked, and asked for, before anything
+	// else happens; -rekey locks with it too
+	if set_password != "" && (*lockflag || *rekeyflag) {
+		if set_password == "-" {
+			if !term.IsTerminal(int(os.Stdin.Fd())) || *pass_stdin || *source == "-" {
+				abort(exit_usage, "-set-password - needs a terminal to ask for the password on")
+			}
+			set_password, err = ask_chosen_password()
+			if err != nil {
+				abort(exit_usage, err.Error())
+			}
+		}
+		add_secret(set_password)
+		if err := check_chosen_password(set_password); err != nil {
+			abort(exit_usage, err.Error())
+		}
+		if chosen_entropy(set_password) < min_entropy_bits {
+			fmt.Fprintln(os.Stderr, "Warning: the chosen password looks easy to guess; a longer one, or a random one, would be harder")
+		}
+	}
+	if scheme != "" {
+		if err := check_scheme(scheme); err != nil {
+			abort(exit_usage, err.Error())
+		}
+	}
+	safes, err = parse_safes(safe)
+	if err != nil {
+		abort(exit_usage, err.Error())
+	}
+	if ca_file == "" {
+		ca_file = configuration.CACert
+	}
+	if ca_file != "" {
+		if insecure {
+			abort(exit_usage, "Use either -insecure or -cacert, not both")
+		}
+		ca_pool, err = load_ca_file(ca_file)
+		if err != nil {
+			abort(exit_config, err.Error())
+		}
+	}
+	if insecure {
+		fmt.Fprintln(os.Stderr, "WARNING: -insecure is set, so the safe's certificate is NOT being checked.\nAnyone on the network could pretend to be the safe and see its password.")
+	}
+
+	for _, s := range safes {
+		use_safe(s)
+		if err := check_safe_url(); err != nil {
+			abort(exit_usage, err.Error())
+		}
+	}
+	use_safe(safes[0])
+
+	// Anything from here talks to the safe, so only one copy of us at a
+	// time.  -serve takes the lock for each request instead.
+	if serve_addr == "" {
+		held, err := lock_safe()
+		if err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		defer held.Close()
+	}
+
+	if *checkflag {
+		stage = "check"
+		if err := check(); err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		return
+	}
+
+	if *rawflag != "" {
+		stage = "raw"
+		if err := raw_command(*rawflag); err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		return
+	}
+
+	if *statusflag {
+		stage = "status"
+		changed, err := status()
+		if err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		if changed {
+			os.Exit(1)
+		}
+		os.Exit(0)
+	}
+
+	if serve_addr != "" {
+		stage = "serve"
+		if serve_user == "" {
+			serve_user = configuration.ServeUser
+		}
+		if serve_pass == "" {
+			serve_pass = configuration.ServePass
+		}
+		add_secret(serve_pass)
+		err := serve()
+		abort(exit_code(err), err.Error())
+	}
+
+	if *rekeyflag {
+		stage = "rekey"
+		err := rekey(*source, flag.Args())
+		if !dry_run {
+			log_operation("rekey", flag.Args(), err)
+		}
+		if err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		return
+	}
+
+	if unlock_one {
+		*unlockflag = true
+	}
+
+	// -serve has already gone, so there's someone here to ask
+	ask_unlock = true
+	if *lockflag {
+		stage = "lock"
 	} else if *unlockflag {
-		unlock(filename, false)
+		stage = "unlock"
 	} else if *testflag {
-		unlock(filename, true)
+		stage = "test"
+	}
+
+	// Shares of a password come as several images
+	if (*unlockflag || *testflag) && len(flag.Args()) > 1 {
+		err := unlock_shares(flag.Args(), *testflag)
+		if *testflag {
+			log_operation("test", flag.Args(), err)
+		} else {
+			log_operation("unlock", flag.Args(), err)
+		}
+		if err != nil {
+			abort(exit_code(err), err.Error())
+		}
+		return
+	}
+
+	filename, err := get_filename()
+	if err != nil {
+		abort(exit_usage, err.Error())
+	}
+
+	if *lockflag {
+		err = lock(*source, filename)
+		if !dry_run {
+			log_operation("lock", []string{filename}, err)
+		}
+	} else if *unlockflag {
+		err = unlock(filename, false)
+		log_operation("unlock", []string{filename}, err)
+	} else if *testflag {
+		err = unlock(filename, true)
+		log_operation("test", []string{filename}, err)
 	} else {
-		abort("Command should be -lock or -unlock or -test; use -h for help")
+		err = with_code(exit_usage, errors.New("Command should be -lock or -unlock or -test; use -h for help"))
+	}
+	if err != nil {
+		abort(exit_code(err), err.Error())
 	}
 }
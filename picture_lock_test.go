@@ -0,0 +1,644 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"path/filepath"
+	"picture_lock/carrier"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Set the globals that safe_url uses back to their defaults, and put
+// them back afterwards
+func reset_url_globals(t *testing.T) {
+	t.Helper()
+	old_scheme, old_base, old_safe, old_template, old_post := scheme, base_path, safe, url_template, use_post
+	scheme, base_path, safe, url_template, use_post = "", "", "", default_url_template, false
+	t.Cleanup(func() {
+		scheme, base_path, safe, url_template, use_post = old_scheme, old_base, old_safe, old_template, old_post
+	})
+}
+
+func TestNormalizeSafe(t *testing.T) {
+	tests := []struct {
+		in     string
+		want   string
+		scheme string
+		base   string
+		err    string
+	}{
+		{"safe.local", "safe.local", "", "", ""},
+		{"  safe.local:8080/ ", "safe.local:8080", "", "", ""},
+		{"http://safe.local/", "safe.local", "http", "", ""},
+		{"HTTPS://safe.local", "safe.local", "https", "", ""},
+		{"http://proxy/emla/safe//", "proxy", "http", "/emla/safe", ""},
+		{"ftp://safe.local", "", "", "", "Unsupported scheme ftp://"},
+		{"http://", "", "", "", "No safe name passed"},
+		{"///", "", "", "", "No safe name passed"},
+		{"", "", "", "", "No safe name passed"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.in, func(t *testing.T) {
+			reset_url_globals(t)
+			got, err := normalize_safe(tt.in)
+			if tt.err != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.err) {
+					t.Fatalf("normalize_safe(%q) error = %v, want %q", tt.in, err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("normalize_safe(%q) error = %v", tt.in, err)
+			}
+			if want := (safe_address{tt.want, tt.scheme, tt.base}); got != want {
+				t.Errorf("normalize_safe(%q) = %+v, want %+v", tt.in, got, want)
+			}
+		})
+	}
+}
+
+func TestNormalizeSafeSchemeMismatch(t *testing.T) {
+	reset_url_globals(t)
+	scheme = "http"
+	if _, err := normalize_safe("https://safe.local"); err == nil || !strings.Contains(err.Error(), "does not match -scheme") {
+		t.Errorf("error = %v, want a -scheme mismatch", err)
+	}
+}
+
+// Each address in a list keeps its own scheme and path
+func TestParseSafes(t *testing.T) {
+	reset_url_globals(t)
+	old := configuration
+	t.Cleanup(func() { configuration = old })
+	configuration = Configuration{}
+
+	got, err := parse_safes("https://proxy.example/emla/, safe.local:8080, http://safe.local:8080/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []safe_address{
+		{"proxy.example", "https", "/emla/"},
+		{"safe.local:8080", "http", default_base_path},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("parse_safes = %+v, want %+v", got, want)
+	}
+
+	// -base-path and -scheme apply to every address
+	base_path = "/other"
+	got, _ = parse_safes("https://proxy.example/emla/,safe.local")
+	if got[0].base != "/other/" || got[1].base != "/other/" || got[0].scheme != "https" {
+		t.Errorf("with -base-path, parse_safes = %+v", got)
+	}
+	scheme = "http"
+	if _, err := parse_safes("safe.local,https://proxy.example"); err == nil {
+		t.Error("parse_safes took an https address with -scheme http")
+	}
+}
+
+// When the first address doesn't answer, the second is tried with its
+// own scheme and path
+func TestSafeRequestMixedSchemes(t *testing.T) {
+	var path string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		path = r.URL.Path
+		fmt.Fprint(w, "Safe is unlocked")
+	}))
+	defer srv.Close()
+	dead := httptest.NewTLSServer(http.NotFoundHandler())
+	dead_host := dead.Listener.Addr().String()
+	dead.Close()
+
+	use_test_safe(t, srv.URL)
+	old := configuration
+	t.Cleanup(func() { configuration = old })
+	configuration = Configuration{}
+	scheme, base_path = "", ""
+	list, err := parse_safes("https://" + dead_host + "/emla/," + srv.URL + "/safe2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	safes = list
+	use_safe(safes[0])
+
+	res, err := safe_request("status=1")
+	if err != nil || res != "Safe is unlocked" {
+		t.Fatalf("safe_request = %q, %v", res, err)
+	}
+	if path != "/safe2/" || scheme != "http" || !safe_found {
+		t.Errorf("safe got %q over %s, want /safe2/ over http", path, scheme)
+	}
+}
+
+func TestCheckSafeURL(t *testing.T) {
+	tests := []struct {
+		safe string
+		err  string
+	}{
+		{"safe.local", ""},
+		{"safe.local:8080", ""},
+		{"[::1]:80", ""},
+		{"safe.local:0", "port 0 is not valid"},
+		{"safe.local:65536", "port 65536 is not valid"},
+		{"safe.local:http", "not valid"},
+		{":8080", "has no host"},
+		{"safe local", "not valid"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.safe, func(t *testing.T) {
+			reset_url_globals(t)
+			scheme, base_path, safe = "http", default_base_path, tt.safe
+			err := check_safe_url()
+			if tt.err == "" {
+				if err != nil {
+					t.Errorf("check_safe_url() for %q = %v", tt.safe, err)
+				}
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("check_safe_url() for %q = %v, want %q", tt.safe, err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSafeURL(t *testing.T) {
+	reset_url_globals(t)
+	scheme, base_path, safe = "http", default_base_path, "safe.local"
+	if got, want := safe_url("status=1"), "http://safe.local/safe/?status=1"; got != want {
+		t.Errorf("safe_url = %q, want %q", got, want)
+	}
+
+	url_template = "{scheme}://{safe}/{action}/{password}"
+	if got, want := safe_url("unlock=1&unlock=a%2Fb"), "http://safe.local/unlock/a%2Fb"; got != want {
+		t.Errorf("safe_url with a template = %q, want %q", got, want)
+	}
+
+	url_template, use_post = default_url_template, true
+	if got, want := safe_url("unlock=1&unlock=secret"), "http://safe.local/safe/"; got != want {
+		t.Errorf("safe_url with -post = %q, want %q", got, want)
+	}
+}
+
+func TestReadConfigIgnoresEnvironment(t *testing.T) {
+	old := configuration
+	t.Cleanup(func() { configuration = old })
+	configuration = Configuration{}
+
+	file := filepath.Join(t.TempDir(), "config")
+	if err := ioutil.WriteFile(file, []byte("safe: safe.local\nuser: bob\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("OnLock", "echo INJECTED")
+	t.Setenv("Safe", "elsewhere")
+	if err := read_config(file); err != nil {
+		t.Fatal(err)
+	}
+	if configuration.OnLock != "" || configuration.Safe != "safe.local" || configuration.User != "bob" {
+		t.Errorf("configuration = %+v; want just what the file says", configuration)
+	}
+}
+
+func TestHookEnvironment(t *testing.T) {
+	t.Setenv("PICTURE_LOCK_PASS", "hunter22")
+	t.Setenv("PICTURE_LOCK_USER", "bob")
+	t.Setenv("HOOK_TEST_KEEP", "yes")
+
+	env := strings.Join(hook_environment("lock", "lock.jpg", "Safe locked"), "\n")
+	for _, bad := range []string{"hunter22", "PICTURE_LOCK_USER"} {
+		if strings.Contains(env, bad) {
+			t.Errorf("hook environment has %s in it", bad)
+		}
+	}
+	for _, want := range []string{"HOOK_TEST_KEEP=yes", "PICTURE_LOCK_OPERATION=lock", "PICTURE_LOCK_IMAGE=lock.jpg", "PICTURE_LOCK_RESULT=Safe locked"} {
+		if !strings.Contains(env, want) {
+			t.Errorf("hook environment is missing %s", want)
+		}
+	}
+}
+
+func TestGeneratePassword(t *testing.T) {
+	old_length, old_charset := password_length, charset
+	t.Cleanup(func() { password_length, charset = old_length, old_charset })
+
+	// 62 doesn't divide 256, so without rejection sampling the first
+	// 256%62 = 8 characters would come up a fifth more often
+	password_length, charset = max_password_length, pswdstring
+	counts := make(map[rune]int)
+	const rounds = 2000
+	for i := 0; i < rounds; i++ {
+		psw, err := generate_password()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(psw) != password_length {
+			t.Fatalf("password %q is %d characters, want %d", psw, len(psw), password_length)
+		}
+		for _, c := range psw {
+			if !strings.ContainsRune(charset, c) {
+				t.Fatalf("password %q has %q, which isn't in the charset", psw, c)
+			}
+			counts[c]++
+		}
+	}
+
+	// Each character is expected 2000*64/62 ~ 2065 times, with a standard
+	// deviation of about 45; a 20% bias would be ~400 out
+	expected := float64(rounds*password_length) / float64(len(charset))
+	for _, c := range charset {
+		if d := float64(counts[c]) - expected; d > 0.1*expected || d < -0.1*expected {
+			t.Errorf("%q came up %d times, expected about %.0f", c, counts[c], expected)
+		}
+	}
+	var first, last float64
+	for i := 0; i < 8; i++ {
+		first += float64(counts[rune(charset[i])])
+		last += float64(counts[rune(charset[len(charset)-1-i])])
+	}
+	if first > 1.1*last {
+		t.Errorf("the first 8 characters came up %.0f times, the last 8 %.0f; the sampling is biased", first, last)
+	}
+}
+
+// Point the safe at server (e.g. an httptest.Server's URL), with the
+// options main would otherwise set up, and put everything back
+// afterwards
+func use_test_safe(t *testing.T, server string) {
+	t.Helper()
+	old_safe, old_safes, old_found := safe, safes, safe_found
+	old_user, old_pass, old_auth := username, passwd, auth_method
+	old_retries, old_client := retries, http_client
+	old_digest, old_count := digest_last, digest_count
+	t.Cleanup(func() {
+		safe, safes, safe_found = old_safe, old_safes, old_found
+		username, passwd, auth_method = old_user, old_pass, old_auth
+		retries, http_client = old_retries, old_client
+		digest_last, digest_count = old_digest, old_count
+	})
+	reset_url_globals(t)
+
+	u, err := url.Parse(server)
+	if err != nil {
+		t.Fatal(err)
+	}
+	scheme, safe, base_path = u.Scheme, u.Host, default_base_path
+	safes, safe_found = []safe_address{current_safe()}, false
+	username, passwd, auth_method = "", "", "basic"
+	retries, http_client = 0, nil
+	digest_last, digest_count = "", 0
+}
+
+// A password that changes when escaped, so every form of it is checked
+const test_password = "Abc/Def+Ghi%Jkl"
+
+func check_no_password(t *testing.T, err error) {
+	t.Helper()
+	for _, form := range []string{test_password, url.QueryEscape(test_password), url.PathEscape(test_password)} {
+		if strings.Contains(err.Error(), form) {
+			t.Errorf("error %q has the password (as %q) in it", err, form)
+		}
+	}
+}
+
+func TestSafeRequestOK(t *testing.T) {
+	var got string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got = r.URL.Query().Get("unlock")
+		fmt.Fprint(w, "Passwords match")
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+	with_secrets(t, test_password)
+
+	res, err := safe_request("pwtest=1&unlock=" + url.QueryEscape(test_password))
+	if err != nil || res != "Passwords match" {
+		t.Fatalf("safe_request = %q, %v", res, err)
+	}
+	if got != test_password {
+		t.Errorf("safe got the password %q, want %q", got, test_password)
+	}
+}
+
+func TestSafeRequestRefused(t *testing.T) {
+	tests := []struct {
+		status    int
+		auth      bool
+		transient bool
+	}{
+		{http.StatusBadRequest, false, false},
+		{http.StatusForbidden, false, false},
+		{http.StatusNotFound, false, false},
+		{http.StatusUnauthorized, true, false},
+		{http.StatusServiceUnavailable, false, true},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			// Safes (and proxies) like to repeat what they were sent
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.WriteHeader(tt.status)
+				fmt.Fprint(w, "Bad request "+r.URL.RawQuery+" password "+r.URL.Query().Get("unlock"))
+			}))
+			defer srv.Close()
+			use_test_safe(t, srv.URL)
+			with_secrets(t, test_password)
+
+			_, err := safe_request("pwtest=1&unlock=" + url.QueryEscape(test_password))
+			if err == nil {
+				t.Fatal("safe_request succeeded")
+			}
+			if !strings.Contains(err.Error(), fmt.Sprint(tt.status)) {
+				t.Errorf("error %q doesn't give the status", err)
+			}
+			if _, ok := err.(auth_error); ok != tt.auth {
+				t.Errorf("error %q: auth_error is %v, want %v", err, ok, tt.auth)
+			}
+			if _, ok := err.(transient_error); ok != tt.transient {
+				t.Errorf("error %q: transient_error is %v, want %v", err, ok, tt.transient)
+			}
+			check_no_password(t, err)
+		})
+	}
+}
+
+// Stands in for a network that isn't there
+type failing_transport struct{}
+
+func (failing_transport) RoundTrip(req *http.Request) (*http.Response, error) {
+	return nil, errors.New("dial tcp: connection refused")
+}
+
+func TestSafeRequestNetworkError(t *testing.T) {
+	use_test_safe(t, "http://safe.invalid")
+	with_secrets(t, test_password)
+	http_client = &http.Client{Transport: failing_transport{}}
+
+	_, err := safe_request("pwtest=1&unlock=" + url.QueryEscape(test_password))
+	if err == nil {
+		t.Fatal("safe_request succeeded")
+	}
+	if _, ok := err.(transient_error); !ok {
+		t.Errorf("error %q isn't a transient_error", err)
+	}
+	if !strings.Contains(err.Error(), "connection refused") {
+		t.Errorf("error %q doesn't say what went wrong", err)
+	}
+	check_no_password(t, err)
+}
+
+func TestPasswordEntropy(t *testing.T) {
+	tests := []struct {
+		length, size int
+		want         float64
+	}{
+		{30, 62, 178.6},
+		{8, 2, 8},
+		{64, 16, 256},
+		{8, 10, 26.6},
+	}
+	for _, tt := range tests {
+		got := password_entropy(tt.length, tt.size)
+		if d := got - tt.want; d > 0.05 || d < -0.05 {
+			t.Errorf("password_entropy(%d, %d) = %.2f, want %.1f", tt.length, tt.size, got, tt.want)
+		}
+	}
+}
+
+func TestChosenEntropy(t *testing.T) {
+	tests := []struct {
+		psw  string
+		want float64
+	}{
+		{"aaaaaaaa", 37.6},
+		{"abcdefgh", 37.6},
+		{"Abcdefgh", 45.6},
+		{"Abcdefg1", 47.6},
+		{"Abc/def1", 51.7},
+		{"correcthorsebatterystaple", 117.5},
+	}
+	for _, tt := range tests {
+		got := chosen_entropy(tt.psw)
+		if d := got - tt.want; d > 0.05 || d < -0.05 {
+			t.Errorf("chosen_entropy(%q) = %.2f, want %.1f", tt.psw, got, tt.want)
+		}
+	}
+}
+
+func TestCheckChosenPassword(t *testing.T) {
+	old := charset
+	t.Cleanup(func() { charset = old })
+	charset = pswdstring
+
+	tests := []struct {
+		psw  string
+		want string
+	}{
+		{"Abcdefg1", ""},
+		{"Abc", "between 8 and 64 characters"},
+		{"Abcdefg/", `"/" at character 8, which isn't in the -charset; -charset full allows it`},
+		{"Abc defg", `" " at character 4, which isn't in the -charset`},
+		{"Abcdéfgh", `"\xc3" at character 5`},
+	}
+	for _, tt := range tests {
+		err := check_chosen_password(tt.psw)
+		if tt.want == "" {
+			if err != nil {
+				t.Errorf("check_chosen_password(%q) = %v", tt.psw, err)
+			}
+			continue
+		}
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("check_chosen_password(%q) = %v, want an error with %q", tt.psw, err, tt.want)
+		} else if strings.Contains(err.Error(), pswdstring) {
+			t.Errorf("check_chosen_password(%q) = %v, which lists the whole charset", tt.psw, err)
+		}
+	}
+	if err := check_chosen_password("Abc defg"); strings.Contains(err.Error(), "full allows") {
+		t.Errorf("check_chosen_password suggests -charset full for a space: %v", err)
+	}
+}
+
+// No comment, other programs' comments and an empty password each get
+// their own error
+func TestMissingPayload(t *testing.T) {
+	old := search_order
+	search_order = "comment"
+	t.Cleanup(func() { search_order = old })
+
+	com := func(data string) carrier.Segment { return carrier.Segment{Marker: carrier.COM, Data: []byte(data)} }
+	app0 := carrier.Segment{Marker: 0xe0, Data: []byte("JFIF\x00")}
+	tests := []struct {
+		name     string
+		segments []carrier.Segment
+		want     string
+	}{
+		{"no comment", []carrier.Segment{app0}, "it has no comment"},
+		{"foreign comment", []carrier.Segment{app0, com("Copyright someone else")}, "it has a comment, but not one holding a password"},
+		{"foreign comments", []carrier.Segment{com("one"), app0, com("two"), com("three")}, "it has 3 comments, but none of them holds a password"},
+		{"empty password", []carrier.Segment{app0, com("LOCKPSW:")}, empty_password.Error()},
+		{"empty v2 password", []carrier.Segment{app0, com(`LOCKPSW:2:{"Password":""}`)}, empty_password.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, _, err := extract_password(carrier.JPEG{Segments: tt.segments})
+			if err == nil || !strings.Contains(err.Error(), tt.want) {
+				t.Errorf("extract_password = %v, want an error with %q", err, tt.want)
+			}
+		})
+	}
+}
+
+// -rekey with a chosen password the image couldn't give back stops
+// before it talks to the safe
+func TestRekeyChecksChosenPassword(t *testing.T) {
+	asked := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		asked++
+		fmt.Fprint(w, "Passwords match")
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+	old_set, old_charset := set_password, charset
+	t.Cleanup(func() { set_password, charset = old_set, old_charset })
+	charset = pswdstring
+
+	dir := t.TempDir()
+	args := []string{filepath.Join(dir, "old.jpg"), filepath.Join(dir, "new.jpg")}
+	for _, psw := range []string{"-", "Abc", "Abcd:efgh", "Abcd/efgh"} {
+		set_password = psw
+		err := rekey("", args)
+		if err == nil || exit_code(err) != exit_usage {
+			t.Errorf("rekey with -set-password %q = %v, want a usage error", psw, err)
+		}
+	}
+	if asked != 0 {
+		t.Errorf("the safe was asked %d times", asked)
+	}
+}
+
+// Even a password too short to be registered as a secret is kept out of
+// what the safe says back, wherever the URL puts it
+func TestSafeRequestShortPassword(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "No such page "+r.URL.String(), http.StatusNotFound)
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+	with_secrets(t)
+	url_template = "{scheme}://{safe}{base}{action}/{password}"
+
+	_, err := safe_request("pwtest=1&unlock=abc")
+	if err == nil {
+		t.Fatal("safe_request succeeded")
+	}
+	if strings.Contains(err.Error(), "abc") {
+		t.Errorf("error %q has the password in it", err)
+	}
+}
+
+// -verify-image-is-lockable goes through the same embed, write and read
+// back for every kind of image, and leaves the target as it was
+func TestVerifyLockable(t *testing.T) {
+	old_verify, old_order, old_length := verify_image, search_order, password_length
+	verify_image, search_order, password_length = true, "comment,trailer,xmp", 30
+	t.Cleanup(func() { verify_image, search_order, password_length = old_verify, old_order, old_length })
+
+	jpg, err := ioutil.ReadFile(filepath.Join("carrier", "testdata", "baseline.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		kind string
+		data []byte
+	}{
+		{"jpeg", jpg},
+		{"webp", webp_test_file(webp_test_chunk("VP8L", webp_vp8l))},
+		{"tiff", tiff_test_file()},
+	}
+	for _, tt := range tests {
+		target, err := prepare_target("source", tt.data, "lock")
+		if err != nil {
+			t.Fatalf("%s: prepare_target = %v", tt.kind, err)
+		}
+		if target.kind != tt.kind || target.payload != nil || target.write != nil {
+			t.Errorf("%s: verifying changed the target", tt.kind)
+		}
+		if err := target.embed(encode_payload(test_password, PayloadOptions{})); err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		target.write(&buf)
+		if err := check_lock_image("lock", buf.Bytes(), LockInfo{Password: test_password}); err != nil {
+			t.Errorf("%s: %v", tt.kind, err)
+		}
+	}
+}
+
+// Other programs' comments are kept unless -strip-comments says not to
+func TestEmbedPasswordComments(t *testing.T) {
+	old := strip_comments
+	t.Cleanup(func() { strip_comments = old })
+
+	src := carrier.JPEG{Segments: []carrier.Segment{
+		{Marker: 0xe0, Data: []byte("JFIF\x00")},
+		{Marker: carrier.COM, Data: []byte("Copyright someone else")},
+	}}
+	for _, strip := range []bool{false, true} {
+		strip_comments = strip
+		image := src
+		if err := embed_password(&image, encode_payload(test_password, PayloadOptions{})); err != nil {
+			t.Fatal(err)
+		}
+		comments := 0
+		for _, s := range image.Segments {
+			if s.Marker == carrier.COM {
+				comments++
+			}
+		}
+		if want := map[bool]int{false: 2, true: 1}[strip]; comments != want {
+			t.Errorf("-strip-comments %v: %d comments, want %d", strip, comments, want)
+		}
+		if _, ok := carrier.GetComment(image, payload_prefix); !ok {
+			t.Errorf("-strip-comments %v: no password comment", strip)
+		}
+	}
+}
+
+// A dry run against a locked safe says it's locked, but still checks
+// the rest and doesn't fail
+func TestDryRunLockedSafe(t *testing.T) {
+	var cmds []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cmds = append(cmds, r.URL.RawQuery)
+		fmt.Fprint(w, "Safe is locked")
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+	old_dry, old_length, old_charset, old_order := dry_run, password_length, charset, search_order
+	t.Cleanup(func() { dry_run, password_length, charset, search_order = old_dry, old_length, old_charset, old_order })
+	dry_run, password_length, charset, search_order = true, 30, pswdstring, "comment,trailer,xmp"
+
+	dest := filepath.Join(t.TempDir(), "lock.jpg")
+	if err := lock(filepath.Join("carrier", "testdata", "baseline.jpg"), dest); err != nil {
+		t.Fatalf("lock = %v", err)
+	}
+	for _, c := range cmds {
+		if strings.Contains(c, "lock=") {
+			t.Errorf("a dry run sent %q", c)
+		}
+	}
+	if _, err := ioutil.ReadFile(dest); err == nil {
+		t.Error("a dry run wrote the lock image")
+	}
+
+	dry_run = false
+	if err := lock(filepath.Join("carrier", "testdata", "baseline.jpg"), dest); err == nil || !strings.Contains(err.Error(), "already locked") {
+		t.Errorf("a real lock of a locked safe = %v", err)
+	}
+}
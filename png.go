@@ -0,0 +1,129 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// PNG lock images
+//
+// A PNG is an 8 byte signature followed by chunks, each of which is a
+// 4 byte length, 4 byte type, the data and a CRC of the type and data.
+// We keep every chunk as-is (so IHDR, IDAT, IEND etc are untouched)
+// and store the payload in a tEXt chunk with the keyword picture_lock.
+//
+//////////////////////////////////////////////////////////////////////
+
+const png_signature = "\x89PNG\r\n\x1a\n"
+
+// tEXt keyword the payload is stored under
+const png_keyword = "picture_lock"
+
+type PNG_Chunk struct {
+	kind string
+	data []byte
+}
+
+type PNG struct {
+	chunks []PNG_Chunk
+}
+
+func is_png(data []byte) bool {
+	return bytes.HasPrefix(data, []byte(png_signature))
+}
+
+func parse_png(img []byte) (PNG, error) {
+	var image PNG
+	if !is_png(img) {
+		return image, errors.New("Not a PNG file")
+	}
+
+	offset := len(png_signature)
+	for offset < len(img) {
+		if offset+8 > len(img) {
+			return image, errors.New("Bad PNG - truncated chunk header at " + strconv.Itoa(offset))
+		}
+		size := int(binary.BigEndian.Uint32(img[offset:]))
+		end := offset + 8 + size + 4
+		if size < 0 || end > len(img) || end < offset {
+			return image, errors.New("Bad PNG - chunk at " + strconv.Itoa(offset) + " runs past the end of the file")
+		}
+		kind := string(img[offset+4 : offset+8])
+		data := img[offset+8 : offset+8+size]
+		crc := binary.BigEndian.Uint32(img[end-4:])
+		if crc != crc32.ChecksumIEEE(img[offset+4:offset+8+size]) {
+			return image, errors.New("Bad PNG - bad CRC on " + kind + " chunk at " + strconv.Itoa(offset))
+		}
+		image.chunks = append(image.chunks, PNG_Chunk{kind, data})
+		offset = end
+		if kind == "IEND" {
+			break
+		}
+	}
+
+	if len(image.chunks) == 0 || image.chunks[0].kind != "IHDR" {
+		return image, errors.New("Bad PNG - no IHDR chunk")
+	}
+	if image.chunks[len(image.chunks)-1].kind != "IEND" {
+		return image, errors.New("Bad PNG - no IEND chunk")
+	}
+	return image, nil
+}
+
+func write_png(f io.Writer, image PNG) error {
+	_, err := f.Write([]byte(png_signature))
+	if err != nil {
+		return err
+	}
+	for _, c := range image.chunks {
+		var head [8]byte
+		binary.BigEndian.PutUint32(head[:4], uint32(len(c.data)))
+		copy(head[4:], c.kind)
+		crc := crc32.NewIEEE()
+		crc.Write(head[4:])
+		crc.Write(c.data)
+		var tail [4]byte
+		binary.BigEndian.PutUint32(tail[:], crc.Sum32())
+
+		for _, b := range [][]byte{head[:], c.data, tail[:]} {
+			if _, err = f.Write(b); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// A tEXt chunk is the keyword, a zero byte, then the text
+func png_text(image PNG) ([]byte, bool) {
+	prefix := []byte(png_keyword + "\x00")
+	for _, c := range image.chunks {
+		if c.kind == "tEXt" && bytes.HasPrefix(c.data, prefix) {
+			return c.data[len(prefix):], true
+		}
+	}
+	return nil, false
+}
+
+// Replace any old payload with a new one, just before IEND
+func embed_png_password(image *PNG, payload []byte) {
+	prefix := []byte(png_keyword + "\x00")
+
+	var chunks []PNG_Chunk
+	for _, c := range image.chunks {
+		if c.kind == "tEXt" && bytes.HasPrefix(c.data, prefix) {
+			continue
+		}
+		if c.kind == "IEND" {
+			chunks = append(chunks, PNG_Chunk{"tEXt", append(prefix, payload...)})
+		}
+		chunks = append(chunks, c)
+	}
+	image.chunks = chunks
+}
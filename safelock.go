@@ -0,0 +1,85 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// One at a time
+//
+// Two copies of this program talking to the same safe at once (say,
+// overlapping cron jobs) could have one lock the safe while the other
+// is reading its status or unlocking it.  So before talking to a safe
+// we take an advisory lock on a file named after it, and hold it until
+// we're done.  Another copy either waits for it, with -wait, or stops
+// straight away.
+//
+//////////////////////////////////////////////////////////////////////
+
+// Where the lock files go; by default a directory under the user's
+// cache directory
+var lock_dir string
+
+// How long to wait for another copy to finish with the safe
+var lock_wait time.Duration
+
+var lock_name_chars = regexp.MustCompile(`[^A-Za-z0-9.-]+`)
+
+func safe_lock_path() (string, error) {
+	dir := lock_dir
+	if dir == "" {
+		cache, err := os.UserCacheDir()
+		if err != nil {
+			return "", errors.New("Could not find a directory for the lock file; use -lock-dir: " + err.Error())
+		}
+		dir = filepath.Join(cache, "picture_lock")
+		if err := os.MkdirAll(dir, 0700); err != nil {
+			return "", errors.New("Could not make a directory for the lock file; use -lock-dir: " + err.Error())
+		}
+	}
+	return filepath.Join(dir, lock_name_chars.ReplaceAllString(safes[0].host, "_")+".lock"), nil
+}
+
+// Get the safe to ourselves; close the file to let it go again
+func lock_safe() (*os.File, error) {
+	path, err := safe_lock_path()
+	if err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.New("Could not open the lock file " + path + ": " + err.Error())
+	}
+
+	deadline := time.Now().Add(lock_wait)
+	waiting := false
+	for {
+		ok, err := try_lock_file(f)
+		if err != nil {
+			f.Close()
+			return nil, errors.New("Could not lock " + path + ": " + err.Error())
+		}
+		if ok {
+			verbose_msg("Holding lock file " + path)
+			return f, nil
+		}
+		if !time.Now().Before(deadline) {
+			f.Close()
+			msg := "Another copy of picture_lock is using safe " + safe + " (lock file " + path + ")"
+			if waiting {
+				return nil, with_code(exit_busy, errors.New(msg+", and didn't finish within "+lock_wait.String()))
+			}
+			return nil, with_code(exit_busy, errors.New(msg+"; try again later, or use -wait"))
+		}
+		if !waiting {
+			info_msg(os.Stderr, "Waiting for another copy of picture_lock to finish with safe "+safe)
+			waiting = true
+		}
+		time.Sleep(250 * time.Millisecond)
+	}
+}
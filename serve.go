@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Local HTTP API
+//
+// A small server so other systems (e.g. home automation dashboards)
+// can check and unlock the safe without running this program
+// themselves.  The endpoints are
+//   GET  /status           safe status
+//   POST /test   (image)   test the image can unlock the safe
+//   POST /unlock (image)   unlock the safe with the image
+// The image is sent as the request body.  Only the safe's reply is
+// ever returned; the embedded password never is.
+//
+//////////////////////////////////////////////////////////////////////
+
+var serve_addr, serve_user, serve_pass string
+
+// Lock images are small; don't let a client make us read a huge body
+const max_upload = 20 * 1024 * 1024
+
+// Requests to this server queue for the safe between themselves; the
+// lock file only keeps out other copies of the program
+var serve_mutex sync.Mutex
+
+func serve_auth(w http.ResponseWriter, r *http.Request) bool {
+	user, pass, ok := r.BasicAuth()
+	if ok &&
+		subtle.ConstantTimeCompare([]byte(user), []byte(serve_user)) == 1 &&
+		subtle.ConstantTimeCompare([]byte(pass), []byte(serve_pass)) == 1 {
+		return true
+	}
+	w.Header().Set("WWW-Authenticate", `Basic realm="picture_lock"`)
+	http.Error(w, "Unauthorized", http.StatusUnauthorized)
+	return false
+}
+
+func serve_status(w http.ResponseWriter, r *http.Request) {
+	if !serve_auth(w, r) {
+		return
+	}
+	if r.Method != "GET" {
+		http.Error(w, "Use GET", http.StatusMethodNotAllowed)
+		return
+	}
+	serve_mutex.Lock()
+	defer serve_mutex.Unlock()
+	held, err := lock_safe()
+	if err != nil {
+		http.Error(w, redact(err.Error()), http.StatusServiceUnavailable)
+		return
+	}
+	defer held.Close()
+	res, err := safe_request("status=1")
+	if err != nil {
+		http.Error(w, redact(err.Error()), http.StatusBadGateway)
+		return
+	}
+	fmt.Fprintln(w, redact(res))
+}
+
+func serve_unlock(tst bool) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !serve_auth(w, r) {
+			return
+		}
+		if r.Method != "POST" {
+			http.Error(w, "POST the lock image", http.StatusMethodNotAllowed)
+			return
+		}
+
+		data, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, max_upload))
+		if err != nil {
+			http.Error(w, "Could not read image: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		serve_mutex.Lock()
+		defer serve_mutex.Unlock()
+		held, err := lock_safe()
+		if err != nil {
+			http.Error(w, redact(err.Error()), http.StatusServiceUnavailable)
+			return
+		}
+		defer held.Close()
+
+		res, err := unlock_image("(uploaded)", data, tst)
+		if tst {
+			log_operation("test", []string{"(uploaded)"}, err)
+		} else {
+			log_operation("unlock", []string{"(uploaded)"}, err)
+		}
+		if err != nil {
+			http.Error(w, redact(err.Error()), http.StatusBadGateway)
+			return
+		}
+		fmt.Fprintln(w, redact(res))
+	}
+}
+
+// Only returns if the server can't run
+func serve() error {
+	if serve_user == "" || serve_pass == "" {
+		return errors.New("-serve needs -serve-user and -serve-pass (or ServeUser and ServePass in the config file)")
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/status", serve_status)
+	mux.HandleFunc("/test", serve_unlock(true))
+	mux.HandleFunc("/unlock", serve_unlock(false))
+
+	fmt.Fprintln(os.Stderr, "Listening on "+serve_addr)
+	err := http.ListenAndServe(serve_addr, mux)
+	return errors.New("Server stopped: " + err.Error())
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Requests that arrive together all get an answer, one after another
+func TestServeQueues(t *testing.T) {
+	var mu sync.Mutex
+	busy, overlapped := false, false
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		overlapped = overlapped || busy
+		busy = true
+		mu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		mu.Lock()
+		busy = false
+		mu.Unlock()
+		fmt.Fprint(w, "Safe is unlocked")
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+
+	old_dir, old_wait, old_user, old_pass := lock_dir, lock_wait, serve_user, serve_pass
+	lock_dir, lock_wait, serve_user, serve_pass = t.TempDir(), 0, "dash", "secret"
+	t.Cleanup(func() { lock_dir, lock_wait, serve_user, serve_pass = old_dir, old_wait, old_user, old_pass })
+
+	var wg sync.WaitGroup
+	codes := make([]int, 4)
+	for i := range codes {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			r := httptest.NewRequest("GET", "/status", nil)
+			r.SetBasicAuth("dash", "secret")
+			w := httptest.NewRecorder()
+			serve_status(w, r)
+			codes[i] = w.Code
+		}(i)
+	}
+	wg.Wait()
+	for i, code := range codes {
+		if code != http.StatusOK {
+			t.Errorf("request %d got %d, want 200", i, code)
+		}
+	}
+	if overlapped {
+		t.Error("the safe was sent two requests at once")
+	}
+}
+
+// What goes back to the client never has a password in it, even when the
+// safe's error does
+func TestServeRedacts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Error(w, "proxy error for "+test_password, http.StatusBadGateway)
+	}))
+	defer srv.Close()
+	use_test_safe(t, srv.URL)
+	with_secrets(t, test_password)
+
+	old_dir, old_user, old_pass := lock_dir, serve_user, serve_pass
+	lock_dir, serve_user, serve_pass = t.TempDir(), "dash", "secret"
+	t.Cleanup(func() { lock_dir, serve_user, serve_pass = old_dir, old_user, old_pass })
+
+	status := func(want int) {
+		t.Helper()
+		r := httptest.NewRequest("GET", "/status", nil)
+		r.SetBasicAuth("dash", "secret")
+		w := httptest.NewRecorder()
+		serve_status(w, r)
+		if w.Code != want {
+			t.Errorf("got %d, want %d", w.Code, want)
+		}
+		if strings.Contains(w.Body.String(), test_password) {
+			t.Errorf("reply %q has the password in it", w.Body.String())
+		}
+	}
+	status(http.StatusBadGateway)
+
+	// An error of our own, before the safe is asked
+	lock_dir = filepath.Join(t.TempDir(), "missing", test_password)
+	status(http.StatusServiceUnavailable)
+}
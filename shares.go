@@ -0,0 +1,224 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Splitting the password between images
+//
+// With -shares N -threshold K the password is split using Shamir's
+// secret sharing, so that any K of the N lock images are enough to
+// unlock but fewer tell you nothing about the password.  Each byte of
+// the password is the constant term of a random polynomial of degree
+// K-1 over GF(256); share x holds the value of every polynomial at x.
+// Putting K of them back together is Lagrange interpolation at 0.
+//
+//////////////////////////////////////////////////////////////////////
+
+// With -shares, how many images to split the password between, and how
+// many of them are needed to unlock
+var share_count int
+var share_threshold int
+
+const max_shares = 255
+
+// Multiply in GF(256), using the same polynomial as AES
+func gf_mul(a, b byte) byte {
+	var res byte
+	for b != 0 {
+		if b&1 != 0 {
+			res ^= a
+		}
+		high := a & 0x80
+		a <<= 1
+		if high != 0 {
+			a ^= 0x1b
+		}
+		b >>= 1
+	}
+	return res
+}
+
+// Every non-zero a has a^255 = 1, so a^254 is its inverse
+func gf_inv(a byte) byte {
+	res := byte(1)
+	for i := 0; i < 254; i++ {
+		res = gf_mul(res, a)
+	}
+	return res
+}
+
+// Split secret into n shares, any k of which will rebuild it.  Share i
+// is for x = i+1.
+func split_secret(secret []byte, n, k int) ([][]byte, error) {
+	coeffs := make([]byte, k)
+	shares := make([][]byte, n)
+	for i := range shares {
+		shares[i] = make([]byte, len(secret))
+	}
+	for pos, s := range secret {
+		coeffs[0] = s
+		if _, err := rand.Read(coeffs[1:]); err != nil {
+			return nil, errors.New("Could not generate random shares: " + err.Error())
+		}
+		for i := range shares {
+			x := byte(i + 1)
+			var y byte
+			for c := k - 1; c >= 0; c-- {
+				y = gf_mul(y, x) ^ coeffs[c]
+			}
+			shares[i][pos] = y
+		}
+	}
+	return shares, nil
+}
+
+// Rebuild the secret from shares at these x values
+func combine_shares(xs []byte, shares [][]byte) []byte {
+	secret := make([]byte, len(shares[0]))
+	for i, share := range shares {
+		// The Lagrange basis polynomial for share i, at 0.  In GF(256)
+		// subtracting is the same as adding, which is xor.
+		basis := byte(1)
+		for j := range shares {
+			if i != j {
+				basis = gf_mul(basis, gf_mul(xs[j], gf_inv(xs[i]^xs[j])))
+			}
+		}
+		for pos := range secret {
+			secret[pos] ^= gf_mul(share[pos], basis)
+		}
+	}
+	return secret
+}
+
+func check_share_options() error {
+	if share_count == 0 {
+		if share_threshold != 0 {
+			return errors.New("-threshold needs -shares")
+		}
+		return nil
+	}
+	if lock_count != 0 {
+		return errors.New("Use either -count or -shares, not both")
+	}
+	if share_count < 2 || share_count > max_shares {
+		return errors.New("-shares must be between 2 and " + strconv.Itoa(max_shares))
+	}
+	if share_threshold == 0 {
+		share_threshold = share_count
+	}
+	if share_threshold < 2 || share_threshold > share_count {
+		return errors.New("-threshold must be between 2 and the number of -shares")
+	}
+	return nil
+}
+
+// What to put in each of n lock images: the password itself in every
+// one, or with -shares a different share in each
+func lock_payloads(psw string, n int) ([][]byte, []LockInfo, error) {
+	var payloads [][]byte
+	var want []LockInfo
+	if share_count == 0 {
+		for i := 0; i < n; i++ {
+			payloads = append(payloads, encode_payload(psw, payload_options()))
+			want = append(want, LockInfo{Password: psw})
+		}
+		return payloads, want, nil
+	}
+
+	shares, err := split_secret([]byte(psw), share_count, share_threshold)
+	if err != nil {
+		return nil, nil, err
+	}
+	var set [8]byte
+	if _, err := rand.Read(set[:]); err != nil {
+		return nil, nil, errors.New("Could not generate a share set id: " + err.Error())
+	}
+	for i, s := range shares {
+		info := LockInfo{
+			Share:     hex.EncodeToString(s),
+			ShareX:    i + 1,
+			Shares:    share_count,
+			Threshold: share_threshold,
+			ShareSet:  hex.EncodeToString(set[:]),
+		}
+		payloads = append(payloads, encode_share_payload(info, payload_options()))
+		want = append(want, LockInfo{Share: info.Share})
+	}
+	return payloads, want, nil
+}
+
+// Put the password back together from the images holding its shares.
+// Nothing is sent to the safe unless there are enough of them.
+func rebuild_password(files []string) (string, error) {
+	var first LockInfo
+	var xs []byte
+	var ys [][]byte
+	seen := make(map[int]string)
+	for _, file := range files {
+		data, err := read_file(file)
+		if err != nil {
+			return "", err
+		}
+		info, err := trusted_lock_info(data)
+		if err != nil {
+			return "", errors.New(file + ": " + err.Error())
+		}
+		if info.Share == "" {
+			return "", errors.New(file + " holds a whole password, not a share; unlock with it on its own")
+		}
+		if len(xs) == 0 {
+			first = info
+		} else if info.ShareSet != first.ShareSet || info.Threshold != first.Threshold {
+			return "", errors.New(file + " is from a different lock than " + files[0])
+		}
+		if other, ok := seen[info.ShareX]; ok {
+			return "", errors.New(file + " and " + other + " hold the same share")
+		}
+		seen[info.ShareX] = file
+		y, err := hex.DecodeString(info.Share)
+		if err != nil || (len(ys) > 0 && len(y) != len(ys[0])) || info.ShareX < 1 || info.ShareX > max_shares {
+			return "", errors.New(file + " has a damaged share")
+		}
+		verbose_msg(file + " holds share " + strconv.Itoa(info.ShareX) + " of " + strconv.Itoa(info.Shares))
+		xs = append(xs, byte(info.ShareX))
+		ys = append(ys, y)
+	}
+
+	if len(xs) < first.Threshold {
+		return "", errors.New("Only " + strconv.Itoa(len(xs)) + " of the " + strconv.Itoa(first.Threshold) + " shares needed were given; the safe has not been contacted")
+	}
+	// Each share was checked against its own checksum as it was read
+	psw := string(combine_shares(xs, ys))
+	if check_password(psw) != nil {
+		return "", errors.New("The shares do not make a good password; one may be damaged")
+	}
+	return psw, nil
+}
+
+// Unlock (or test) with K or more share images
+func unlock_shares(files []string, tst bool) error {
+	psw, err := rebuild_password(files)
+	if err != nil {
+		return with_code(exit_image, err)
+	}
+	add_secret(psw)
+
+	res, err := send_unlock(strings.Join(files, ","), psw, tst)
+	if err != nil {
+		return err
+	}
+	return report_unlock(res, tst)
+}
+
+// For -test-all-stores etc
+func describe_share(info LockInfo) string {
+	return "share " + strconv.Itoa(info.ShareX) + " of " + strconv.Itoa(info.Shares) + ", " + strconv.Itoa(info.Threshold) + " needed"
+}
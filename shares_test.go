@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/hex"
+	"strings"
+	"testing"
+)
+
+func TestSplitCombine(t *testing.T) {
+	secret := []byte("CorrectHorseBatteryStaple42")
+	shares, err := split_secret(secret, 5, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, pick := range [][]int{{0, 1, 2}, {4, 2, 0}, {1, 3, 4, 0}} {
+		var xs []byte
+		var ys [][]byte
+		for _, i := range pick {
+			xs = append(xs, byte(i+1))
+			ys = append(ys, shares[i])
+		}
+		if got := combine_shares(xs, ys); string(got) != string(secret) {
+			t.Errorf("shares %v gave %q", pick, got)
+		}
+	}
+	if got := combine_shares([]byte{1, 2}, shares[:2]); string(got) == string(secret) {
+		t.Error("2 of 3 needed shares rebuilt the secret")
+	}
+}
+
+// A share's checksum is of the share, never of the whole password
+func TestSharePayloadChecksum(t *testing.T) {
+	old_count, old_threshold, old_algo := share_count, share_threshold, checksum_algo
+	t.Cleanup(func() { share_count, share_threshold, checksum_algo = old_count, old_threshold, old_algo })
+	share_count, share_threshold, checksum_algo = 3, 2, "sha256"
+
+	psw := "weakpassword"
+	whole, _ := make_checksum("sha256", psw)
+	payloads, _, err := lock_payloads(psw, 3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, p := range payloads {
+		if strings.Contains(string(p), whole) || strings.Contains(string(p), strings.SplitN(whole, ":", 2)[1]) {
+			t.Errorf("share %d has the whole password's checksum in it", i+1)
+		}
+		_, info, err := decode_payload(p)
+		if err != nil {
+			t.Fatalf("share %d: %v", i+1, err)
+		}
+		if want, _ := make_checksum("sha256", info.Share); info.Checksum != want {
+			t.Errorf("share %d checksum %q, want the share's own %q", i+1, info.Checksum, want)
+		}
+
+		// A damaged share is caught as it's read
+		y, _ := hex.DecodeString(info.Share)
+		y[0] ^= 1
+		damaged := strings.Replace(string(p), info.Share, hex.EncodeToString(y), 1)
+		if _, _, err := decode_payload([]byte(damaged)); err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Errorf("share %d damaged: decode_payload = %v, want a checksum error", i+1, err)
+		}
+	}
+}
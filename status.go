@@ -0,0 +1,303 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Safe status
+//
+// The safe answers status=1 with human readable text.  We pick out
+// whether it's locked and, if it says, how long is left, so status can
+// be saved and compared later.
+//
+//////////////////////////////////////////////////////////////////////
+
+type SafeStatus struct {
+	Locked bool
+	// Seconds left on the lock, if the safe told us
+	Remaining int64 `json:",omitempty"`
+	// When we asked
+	Time string
+	Raw  string
+	// Only in -json output: what -diff found, or why Raw made no sense
+	Changes []string `json:",omitempty"`
+	Error   string   `json:",omitempty"`
+}
+
+// Durations are given as e.g. "2 days, 4 hours" or as "04:10:00"
+var duration_words = regexp.MustCompile(`(?i)(\d+)\s*(day|hour|hr|minute|min|second|sec)s?\b`)
+var duration_clock = regexp.MustCompile(`\b(?:(\d+):)?(\d{1,2}):(\d{2}):(\d{2})\b`)
+
+func parse_remaining(raw string) (time.Duration, bool) {
+	units := map[string]time.Duration{
+		"day": 24 * time.Hour, "hour": time.Hour, "hr": time.Hour,
+		"minute": time.Minute, "min": time.Minute,
+		"second": time.Second, "sec": time.Second,
+	}
+
+	var total time.Duration
+	found := false
+	for _, m := range duration_words.FindAllStringSubmatch(raw, -1) {
+		n, _ := strconv.Atoi(m[1])
+		total += time.Duration(n) * units[strings.ToLower(m[2])]
+		found = true
+	}
+	if found {
+		return total, true
+	}
+
+	if m := duration_clock.FindStringSubmatch(raw); m != nil {
+		var parts [4]int
+		for i := range parts {
+			parts[i], _ = strconv.Atoi(m[i+1])
+		}
+		return time.Duration(parts[0])*24*time.Hour +
+			time.Duration(parts[1])*time.Hour +
+			time.Duration(parts[2])*time.Minute +
+			time.Duration(parts[3])*time.Second, true
+	}
+	return 0, false
+}
+
+func parse_status(raw string) (SafeStatus, error) {
+	st := SafeStatus{Raw: raw, Time: time.Now().UTC().Format(time.RFC3339)}
+	lower := strings.ToLower(raw)
+	if strings.Contains(lower, "unlocked") {
+		st.Locked = false
+	} else if strings.Contains(lower, "locked") {
+		st.Locked = true
+	} else {
+		return st, errors.New("Could not understand safe status: " + raw)
+	}
+
+	if st.Locked {
+		if d, ok := parse_remaining(raw); ok {
+			st.Remaining = int64(d / time.Second)
+		}
+	}
+	return st, nil
+}
+
+// How long a lock has left, and whether the safe is locked at all.  A
+// locked safe that doesn't say how long is left gives 0.
+func lock_remaining(raw string) (time.Duration, bool) {
+	st, err := parse_status(raw)
+	if err != nil || !st.Locked {
+		return 0, false
+	}
+	return time.Duration(st.Remaining) * time.Second, true
+}
+
+// e.g. "2 days, 4 hours" - the two biggest units is enough for anyone
+func human_duration(d time.Duration) string {
+	units := []struct {
+		name string
+		size time.Duration
+	}{
+		{"day", 24 * time.Hour}, {"hour", time.Hour}, {"minute", time.Minute}, {"second", time.Second},
+	}
+
+	var parts []string
+	for _, u := range units {
+		n := int64(d / u.size)
+		if n == 0 && len(parts) == 0 {
+			continue
+		}
+		d -= time.Duration(n) * u.size
+		if n == 1 {
+			parts = append(parts, "1 "+u.name)
+		} else if n > 1 {
+			parts = append(parts, strconv.FormatInt(n, 10)+" "+u.name+"s")
+		}
+		if len(parts) == 2 || (len(parts) == 1 && n == 0) {
+			break
+		}
+	}
+	if len(parts) == 0 {
+		return "less than a second"
+	}
+	return strings.Join(parts, ", ")
+}
+
+func lock_word(locked bool) string {
+	if locked {
+		return "locked"
+	}
+	return "unlocked"
+}
+
+// Compare the status now with an earlier snapshot.  Remaining time
+// should have gone down by however long it's been; more than a minute
+// out either way is reported.
+func status_diff(old, cur SafeStatus) []string {
+	var res []string
+	if old.Locked != cur.Locked {
+		res = append(res, "Safe was "+lock_word(old.Locked)+", now "+lock_word(cur.Locked))
+	}
+
+	if old.Locked && cur.Locked && old.Remaining > 0 {
+		then, err1 := time.Parse(time.RFC3339, old.Time)
+		now, err2 := time.Parse(time.RFC3339, cur.Time)
+		if err1 == nil && err2 == nil {
+			elapsed := now.Sub(then)
+			change := time.Duration(old.Remaining-cur.Remaining) * time.Second
+			if d := change - elapsed; d > time.Minute || d < -time.Minute {
+				res = append(res, "Remaining time went down by "+change.String()+" but "+elapsed.Round(time.Second).String()+" has passed")
+			}
+		}
+	}
+	return res
+}
+
+func save_status(file string, st SafeStatus) error {
+	data, _ := json.MarshalIndent(st, "", "  ")
+	return ioutil.WriteFile(file, append(data, '\n'), 0600)
+}
+
+func load_status(file string) (SafeStatus, error) {
+	var st SafeStatus
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return st, errors.New("Could not read status baseline " + file)
+	}
+	if err := json.Unmarshal(data, &st); err != nil {
+		return st, errors.New("Bad status baseline " + file + ": " + err.Error())
+	}
+	return st, nil
+}
+
+// Status files to save to, and compare against
+var snapshot_file, diff_file string
+
+// Print the status as JSON rather than the safe's own words
+var json_output bool
+
+// Print a status for scripts
+func print_status_json(st SafeStatus) {
+	data, _ := json.MarshalIndent(st, "", "  ")
+	fmt.Println(string(data))
+}
+
+// -check: ask for the status and say, in plain words, how far we got.
+// A failed lock could be the network, the credentials or the image;
+// this takes the image out of it.
+func check() error {
+	fmt.Println("Safe: " + redact(safe_url("status=1")))
+	if len(safes) > 1 {
+		var rest []string
+		for _, a := range safes[1:] {
+			rest = append(rest, a.String())
+		}
+		fmt.Println("Or, if that doesn't answer: " + strings.Join(rest, ", "))
+	}
+	switch auth_method {
+	case "bearer":
+		fmt.Println("Authentication: bearer token")
+	default:
+		if user, _ := get_credentials(); user != "" {
+			fmt.Println("Authentication: " + auth_method + ", as " + user)
+		} else {
+			fmt.Println("Authentication: none (no -user given)")
+		}
+	}
+
+	raw, err := safe_request("status=1")
+	if len(safes) > 1 && safe_found {
+		fmt.Println("Answered at: " + current_safe().String())
+	}
+	switch err.(type) {
+	case nil:
+	case transient_error:
+		fmt.Println("Could not reach the safe: " + err.Error())
+		return with_code(exit_safe, errors.New("Check failed"))
+	case auth_error:
+		fmt.Println("Reached the safe, but it did not accept the credentials: " + err.Error())
+		return with_code(exit_safe, errors.New("Check failed"))
+	default:
+		fmt.Println("Reached the safe, but it did not answer the status request: " + err.Error())
+		return with_code(exit_safe, errors.New("Check failed"))
+	}
+	fmt.Println("Reached the safe, and it accepted the credentials (or didn't need any)")
+
+	st, err := parse_status(raw)
+	if err != nil {
+		fmt.Println("The safe answered, but not in a way we understand: " + raw)
+		return with_code(exit_safe, errors.New("Check failed; the safe may need -url-template or -base-path"))
+	}
+	if left, locked := lock_remaining(raw); locked && left > 0 {
+		fmt.Println("The safe is locked, with " + human_duration(left) + " remaining")
+	} else {
+		fmt.Println("The safe is " + lock_word(st.Locked))
+	}
+	info_msg(os.Stdout, "All OK")
+	return nil
+}
+
+// Show the safe status, returning true if -diff found anything
+func status() (bool, error) {
+	raw, err := safe_request("status=1")
+	if err != nil {
+		return false, err
+	}
+	if !json_output {
+		fmt.Println(raw)
+		if left, locked := lock_remaining(raw); locked && left > 0 {
+			fmt.Println(human_duration(left) + " remaining")
+		}
+		if snapshot_file == "" && diff_file == "" {
+			return false, nil
+		}
+	}
+
+	cur, err := parse_status(raw)
+	if err != nil {
+		// Scripts still get the raw text, and an error to look at
+		if json_output {
+			cur.Error = err.Error()
+			print_status_json(cur)
+			if snapshot_file == "" && diff_file == "" {
+				return false, nil
+			}
+		}
+		return false, err
+	}
+
+	var changes []string
+	if diff_file != "" {
+		old, err := load_status(diff_file)
+		if err != nil {
+			return false, err
+		}
+		changes = status_diff(old, cur)
+		if !json_output {
+			for _, line := range changes {
+				fmt.Println(line)
+			}
+			if len(changes) == 0 {
+				info_msg(os.Stdout, "No unexpected changes since "+old.Time)
+			}
+		}
+	}
+
+	if snapshot_file != "" {
+		if err := save_status(snapshot_file, cur); err != nil {
+			return false, errors.New("Could not save status to " + snapshot_file + ": " + err.Error())
+		}
+	}
+
+	if json_output {
+		cur.Changes = changes
+		print_status_json(cur)
+	}
+	return len(changes) > 0, nil
+}
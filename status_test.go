@@ -0,0 +1,122 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+func TestParseStatus(t *testing.T) {
+	tests := []struct {
+		raw       string
+		locked    bool
+		remaining int64
+		err       bool
+	}{
+		{"Safe is unlocked", false, 0, false},
+		{"Safe is locked", true, 0, false},
+		{"SAFE IS LOCKED\n", true, 0, false},
+		{"Safe is locked: 2 days, 4 hours remaining", true, 187200, false},
+		{"Remaining: 01:02:03 until open LOCKED", true, 3723, false},
+		{"Locked, 1:00:00:30 left", true, 86430, false},
+		{"Safe is unlocked (was locked for 3 hours)", false, 0, false},
+		{"", false, 0, true},
+		{"<html>502 Bad Gateway</html>", false, 0, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.raw, func(t *testing.T) {
+			st, err := parse_status(tt.raw)
+			if tt.err {
+				if err == nil {
+					t.Errorf("parse_status(%q) = %+v, want an error", tt.raw, st)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("parse_status(%q) error = %v", tt.raw, err)
+			}
+			if st.Locked != tt.locked || st.Remaining != tt.remaining || st.Raw != tt.raw {
+				t.Errorf("parse_status(%q) = %+v, want locked %v, remaining %d", tt.raw, st, tt.locked, tt.remaining)
+			}
+			if _, err := time.Parse(time.RFC3339, st.Time); err != nil {
+				t.Errorf("parse_status(%q) Time = %q: %v", tt.raw, st.Time, err)
+			}
+		})
+	}
+}
+
+// -status -json leaves out what it doesn't know
+func TestStatusJSON(t *testing.T) {
+	st, err := parse_status("Safe is unlocked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := json.Marshal(st)
+	var fields map[string]interface{}
+	json.Unmarshal(data, &fields)
+	for _, f := range []string{"Locked", "Time", "Raw"} {
+		if _, ok := fields[f]; !ok {
+			t.Errorf("JSON status %s has no %s", data, f)
+		}
+	}
+	for _, f := range []string{"Remaining", "Changes", "Error"} {
+		if _, ok := fields[f]; ok {
+			t.Errorf("JSON status %s has %s, which should be left out", data, f)
+		}
+	}
+}
+
+func TestStatusDiff(t *testing.T) {
+	old := SafeStatus{Locked: true, Remaining: 3600, Time: "2026-01-01T00:00:00Z"}
+	if d := status_diff(old, SafeStatus{Locked: true, Remaining: 3000, Time: "2026-01-01T00:10:00Z"}); len(d) != 0 {
+		t.Errorf("status_diff reported %q for time passing normally", d)
+	}
+	if d := status_diff(old, SafeStatus{Locked: true, Remaining: 7200, Time: "2026-01-01T00:10:00Z"}); len(d) != 1 {
+		t.Errorf("status_diff reported %q for time being added", d)
+	}
+	if d := status_diff(old, SafeStatus{Locked: false, Time: "2026-01-01T00:10:00Z"}); len(d) != 1 {
+		t.Errorf("status_diff reported %q for the safe being unlocked", d)
+	}
+}
+
+func TestParseRemaining(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want time.Duration
+		ok   bool
+	}{
+		{"2 days, 4 hours remaining", 52 * time.Hour, true},
+		{"1 day 1 hr 1 min 1 sec", 25*time.Hour + time.Minute + time.Second, true},
+		{"90 Minutes", 90 * time.Minute, true},
+		{"04:10:00", 4*time.Hour + 10*time.Minute, true},
+		{"3:23:59:59", 3*24*time.Hour + 23*time.Hour + 59*time.Minute + 59*time.Second, true},
+		{"Safe is locked", 0, false},
+		{"10:30", 0, false},
+	}
+	for _, tt := range tests {
+		got, ok := parse_remaining(tt.raw)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("parse_remaining(%q) = %v, %v; want %v, %v", tt.raw, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestHumanDuration(t *testing.T) {
+	tests := []struct {
+		d    time.Duration
+		want string
+	}{
+		{0, "less than a second"},
+		{time.Second, "1 second"},
+		{90 * time.Second, "1 minute, 30 seconds"},
+		{52 * time.Hour, "2 days, 4 hours"},
+		{52*time.Hour + 59*time.Minute, "2 days, 4 hours"},
+		{24*time.Hour + 5*time.Minute, "1 day"},
+		{3 * time.Hour, "3 hours"},
+	}
+	for _, tt := range tests {
+		if got := human_duration(tt.d); got != tt.want {
+			t.Errorf("human_duration(%v) = %q, want %q", tt.d, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"image"
+	"image/color"
+	"image/draw"
+	_ "image/gif"
+	_ "image/jpeg"
+	_ "image/png"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// Hiding the password in the image pixels
+//
+// The payload is written into the least significant bit of the red,
+// green and blue values of each pixel in turn, left to right, top to
+// bottom.  It's preceded by a magic value and the payload length so we
+// can tell if an image has been used.  This only survives lossless
+// formats, so lock images made this way are saved as PNG; a PNG
+// screenshot of one at 100% scale will still work.
+//
+//////////////////////////////////////////////////////////////////////
+
+const steg_magic = "PLSG"
+
+// Bytes of header before the payload
+const steg_header = len(steg_magic) + 4
+
+// How many payload bytes an image can hold
+func steg_capacity(img image.Image) int {
+	b := img.Bounds()
+	res := b.Dx()*b.Dy()*3/8 - steg_header
+	if res < 0 {
+		return 0
+	}
+	return res
+}
+
+// The pixel holding the i'th channel we use, counting red, green and
+// blue (but not alpha) of each pixel in turn
+func steg_pixel(b image.Rectangle, i int) (int, int) {
+	p := i / 3
+	return b.Min.X + p%b.Dx(), b.Min.Y + p/b.Dx()
+}
+
+// Where the i'th channel is in the image's bytes.  This is worked out
+// as it's needed; a table of them all for a big photo would take
+// hundreds of MB.
+func steg_channel(img *image.NRGBA, i int) int {
+	x, y := steg_pixel(img.Bounds(), i)
+	return img.PixOffset(x, y) + i%3
+}
+
+// The low bit of the i'th channel.  An image that isn't NRGBA is
+// converted a pixel at a time, the same way draw.Draw would, so a photo
+// isn't copied just to find there's nothing hidden in it.
+func steg_bit(img image.Image, i int) byte {
+	if n, ok := img.(*image.NRGBA); ok {
+		return n.Pix[steg_channel(n, i)] & 1
+	}
+	c := color.NRGBAModel.Convert(img.At(steg_pixel(img.Bounds(), i))).(color.NRGBA)
+	return [3]uint8{c.R, c.G, c.B}[i%3] & 1
+}
+
+func steg_embed(src image.Image, payload []byte) (*image.NRGBA, error) {
+	if len(payload) > steg_capacity(src) {
+		return nil, errors.New("Image is too small to hide the password in; it can hold " + strconv.Itoa(steg_capacity(src)) + " bytes but " + strconv.Itoa(len(payload)) + " are needed")
+	}
+
+	var size [4]byte
+	binary.BigEndian.PutUint32(size[:], uint32(len(payload)))
+	data := append([]byte(steg_magic), size[:]...)
+	data = append(data, payload...)
+
+	// Work on a copy so the source isn't changed
+	img := image.NewNRGBA(src.Bounds())
+	draw.Draw(img, img.Bounds(), src, src.Bounds().Min, draw.Src)
+
+	for i, c := range data {
+		for bit := 0; bit < 8; bit++ {
+			p := steg_channel(img, i*8+bit)
+			img.Pix[p] = img.Pix[p]&0xfe | (c>>(7-bit))&1
+		}
+	}
+	return img, nil
+}
+
+func steg_extract(img image.Image) ([]byte, bool) {
+	read := func(start, n int) []byte {
+		res := make([]byte, n)
+		for i := range res {
+			for bit := 0; bit < 8; bit++ {
+				res[i] = res[i]<<1 | steg_bit(img, (start+i)*8+bit)
+			}
+		}
+		return res
+	}
+
+	b := img.Bounds()
+	channels := b.Dx() * b.Dy() * 3
+	if channels/8 < steg_header {
+		return nil, false
+	}
+	head := read(0, steg_header)
+	if string(head[:len(steg_magic)]) != steg_magic {
+		return nil, false
+	}
+	size := int(binary.BigEndian.Uint32(head[len(steg_magic):]))
+	if size < 0 || size > channels/8-steg_header {
+		return nil, false
+	}
+	return read(steg_header, size), true
+}
+
+// Try to find a password hidden in the pixels of an image file's data
+func extract_from_pixels(data []byte) (LockInfo, error) {
+	img, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return LockInfo{}, errors.New("Could not decode image: " + err.Error())
+	}
+	payload, ok := steg_extract(img)
+	if !ok {
+		return LockInfo{}, no_payload
+	}
+	_, info, err := decode_payload(payload)
+	return info, err
+}
@@ -0,0 +1,44 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/color"
+	"image/draw"
+	"testing"
+)
+
+func TestStegRoundTrip(t *testing.T) {
+	src := image.NewRGBA(image.Rect(3, 5, 43, 25))
+	draw.Draw(src, src.Bounds(), &image.Uniform{color.RGBA{200, 100, 50, 255}}, image.Point{}, draw.Src)
+	payload := []byte("LOCKPSW:some payload")
+
+	img, err := steg_embed(src, payload)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, ok := steg_extract(img); !ok || !bytes.Equal(got, payload) {
+		t.Errorf("steg_extract = %q, %v; want %q", got, ok, payload)
+	}
+
+	// As it would be after being decoded from a PNG into another type
+	rgba := image.NewRGBA(img.Bounds())
+	draw.Draw(rgba, rgba.Bounds(), img, img.Bounds().Min, draw.Src)
+	if got, ok := steg_extract(rgba); !ok || !bytes.Equal(got, payload) {
+		t.Errorf("steg_extract from RGBA = %q, %v; want %q", got, ok, payload)
+	}
+
+	if _, ok := steg_extract(src); ok {
+		t.Error("steg_extract found a payload in an image without one")
+	}
+}
+
+func TestStegTooSmall(t *testing.T) {
+	src := image.NewNRGBA(image.Rect(0, 0, 4, 4))
+	if _, err := steg_embed(src, make([]byte, steg_capacity(src)+1)); err == nil {
+		t.Error("steg_embed accepted a payload bigger than the image holds")
+	}
+	if _, ok := steg_extract(image.NewNRGBA(image.Rect(0, 0, 1, 1))); ok {
+		t.Error("steg_extract found a payload in a 1x1 image")
+	}
+}
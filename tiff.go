@@ -0,0 +1,223 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// TIFF lock images
+//
+// A TIFF starts "II" (little endian) or "MM" (big endian), then 42 and
+// the offset of the first IFD.  An IFD is a count, that many 12 byte
+// entries (tag, type, count, and the value or an offset to it) and the
+// offset of the next IFD, if there are more pages.  Everything else,
+// strips included, is found through offsets, so rather than move
+// anything we leave the file as it is and add to the end of it: the
+// payload, then a copy of the first IFD with a tag for the payload, and
+// point the header at the new IFD.  When relocking, the old payload is
+// taken out first.
+//
+//////////////////////////////////////////////////////////////////////
+
+// Tags from 65000 up are kept for private use
+const tiff_tag = 65000
+
+// The TIFF type for bytes that are none of the others
+const tiff_undefined = 7
+
+type TIFF_Entry struct {
+	tag   uint16
+	kind  uint16
+	count uint32
+	value []byte // 4 bytes: the value itself if it fits, else its offset
+}
+
+type TIFF struct {
+	data    []byte // the file as it was read
+	order   binary.ByteOrder
+	ifd     uint32       // where the first IFD is
+	entries []TIFF_Entry // of the first IFD
+	next    uint32       // the IFD of the next page, if any
+	extra   []byte       // to add to the end of the file
+}
+
+func is_tiff(data []byte) bool {
+	return bytes.HasPrefix(data, []byte("II*\x00")) || bytes.HasPrefix(data, []byte("MM\x00*"))
+}
+
+func parse_tiff(img []byte) (TIFF, error) {
+	var image TIFF
+	if len(img) >= 4 && (string(img[:4]) == "II+\x00" || string(img[:4]) == "MM\x00+") {
+		return image, errors.New("BigTIFF files are not supported")
+	}
+	if !is_tiff(img) || len(img) < 8 {
+		return image, errors.New("Not a TIFF file")
+	}
+	image.data = img
+	image.order = binary.LittleEndian
+	if img[0] == 'M' {
+		image.order = binary.BigEndian
+	}
+
+	image.ifd = image.order.Uint32(img[4:])
+	offset := int(image.ifd)
+	if offset < 8 || offset+2 > len(img) {
+		return image, errors.New("Bad TIFF - first IFD at " + strconv.Itoa(offset) + " is outside the file")
+	}
+	count := int(image.order.Uint16(img[offset:]))
+	offset += 2
+	if offset+12*count+4 > len(img) {
+		return image, errors.New("Bad TIFF - truncated IFD at " + strconv.Itoa(int(image.ifd)))
+	}
+	for i := 0; i < count; i++ {
+		e := img[offset : offset+12]
+		image.entries = append(image.entries, TIFF_Entry{
+			tag:   image.order.Uint16(e),
+			kind:  image.order.Uint16(e[2:]),
+			count: image.order.Uint32(e[4:]),
+			value: e[8:12],
+		})
+		offset += 12
+	}
+	image.next = image.order.Uint32(img[offset:])
+	return image, nil
+}
+
+func write_tiff(f io.Writer, image TIFF) error {
+	// Only the header changes, to point at the new IFD
+	head := make([]byte, 8)
+	copy(head, image.data[:4])
+	image.order.PutUint32(head[4:], image.ifd)
+
+	for _, b := range [][]byte{head, image.data[8:], image.extra} {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Find our tag's data
+func tiff_payload(image TIFF) ([]byte, bool) {
+	for _, e := range image.entries {
+		if e.tag != tiff_tag {
+			continue
+		}
+		if e.count <= 4 {
+			return e.value[:e.count], true
+		}
+		start := uint64(image.order.Uint32(e.value))
+		if start+uint64(e.count) > uint64(len(image.data)) {
+			return nil, false
+		}
+		return image.data[start : start+uint64(e.count)], true
+	}
+	return nil, false
+}
+
+// Add the payload and a new first IFD, with our tag in it, to the end
+// of the file.  The old IFD is left where it was, but nothing points to
+// it any more.
+func embed_tiff_password(image *TIFF, payload []byte) error {
+	remove_tiff_payload(image)
+
+	// Offsets have to be even
+	var extra []byte
+	pad := func() {
+		if (len(image.data)+len(extra))%2 == 1 {
+			extra = append(extra, 0)
+		}
+	}
+	pad()
+	start := len(image.data) + len(extra)
+	extra = append(extra, payload...)
+	pad()
+	ifd := len(image.data) + len(extra)
+
+	value := make([]byte, 4)
+	image.order.PutUint32(value, uint32(start))
+	ours := TIFF_Entry{tiff_tag, tiff_undefined, uint32(len(payload)), value}
+
+	// Entries have to stay in tag order
+	var entries []TIFF_Entry
+	added := false
+	for _, e := range image.entries {
+		if e.tag == tiff_tag {
+			continue
+		}
+		if e.tag > tiff_tag && !added {
+			entries = append(entries, ours)
+			added = true
+		}
+		entries = append(entries, e)
+	}
+	if !added {
+		entries = append(entries, ours)
+	}
+
+	size := uint64(ifd) + 2 + 12*uint64(len(entries)) + 4
+	if size > 0xffffffff || len(entries) > 0xffff {
+		return errors.New("The TIFF is too big to add the password to")
+	}
+
+	b := make([]byte, 2, 2+12*len(entries)+4)
+	image.order.PutUint16(b, uint16(len(entries)))
+	for _, e := range entries {
+		var ent [12]byte
+		image.order.PutUint16(ent[0:], e.tag)
+		image.order.PutUint16(ent[2:], e.kind)
+		image.order.PutUint32(ent[4:], e.count)
+		copy(ent[8:], e.value)
+		b = append(b, ent[:]...)
+	}
+	var next [4]byte
+	image.order.PutUint32(next[:], image.next)
+	b = append(b, next[:]...)
+
+	image.entries = entries
+	image.ifd = uint32(ifd)
+	image.extra = append(extra, b...)
+	return nil
+}
+
+// A payload we added before mustn't be left in the file for anyone to
+// read.  If it and the IFD after it are what we added to the end, they
+// are cut off again; otherwise the payload is blanked where it is.
+func remove_tiff_payload(image *TIFF) {
+	for _, e := range image.entries {
+		if e.tag != tiff_tag || e.count <= 4 {
+			continue
+		}
+		start := uint64(image.order.Uint32(e.value))
+		end := start + uint64(e.count)
+		if end > uint64(len(image.data)) || start < 8 {
+			return
+		}
+		ifd_end := uint64(image.ifd) + 2 + 12*uint64(len(image.entries)) + 4
+		if ifd_end == uint64(len(image.data)) && (end+1)&^1 == uint64(image.ifd) {
+			image.data = image.data[:start]
+			return
+		}
+		data := append([]byte{}, image.data...)
+		for i := start; i < end; i++ {
+			data[i] = 0
+		}
+		image.data = data
+		return
+	}
+}
+
+// Find the password in a TIFF's tag
+func extract_tiff_password(image TIFF) (LockInfo, error) {
+	payload, ok := tiff_payload(image)
+	if !ok {
+		return LockInfo{}, no_payload
+	}
+	_, info, err := decode_payload(payload)
+	return info, err
+}
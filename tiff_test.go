@@ -0,0 +1,97 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// A 2x1 8 bit RGB TIFF, with BitsPerSample stored outside the IFD
+func tiff_test_file() []byte {
+	le := binary.LittleEndian
+	var b []byte
+	u16 := func(v uint32) { b = append(b, 0, 0); le.PutUint16(b[len(b)-2:], uint16(v)) }
+	u32 := func(v uint32) { b = append(b, 0, 0, 0, 0); le.PutUint32(b[len(b)-4:], v) }
+
+	// tag, type, count and value (or where it is)
+	const bits, strip = 8 + 2 + 12*7 + 4, 8 + 2 + 12*7 + 4 + 6
+	entries := [][4]uint32{
+		{256, 3, 1, 2}, {257, 3, 1, 1}, {258, 3, 3, bits}, {262, 3, 1, 2},
+		{273, 4, 1, strip}, {277, 3, 1, 3}, {279, 4, 1, 6},
+	}
+	b = append(b, "II*\x00"...)
+	u32(8)
+	u16(uint32(len(entries)))
+	for _, e := range entries {
+		u16(e[0])
+		u16(e[1])
+		u32(e[2])
+		if e[1] == 3 && e[2] == 1 {
+			u16(e[3])
+			u16(0)
+		} else {
+			u32(e[3])
+		}
+	}
+	u32(0)
+	b = append(b, 8, 0, 8, 0, 8, 0)
+	return append(b, 255, 0, 0, 0, 0, 255)
+}
+
+func tiff_lock(t *testing.T, data []byte, psw string) []byte {
+	t.Helper()
+	image, err := parse_tiff(data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := embed_tiff_password(&image, encode_payload(psw, PayloadOptions{})); err != nil {
+		t.Fatal(err)
+	}
+	var buf bytes.Buffer
+	if err := write_tiff(&buf, image); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// Relocking leaves just the new password in the file, as -rekey does
+// when the old lock image is the source
+func TestTIFFRelock(t *testing.T) {
+	orig := tiff_test_file()
+	first := tiff_lock(t, orig, "FirstPassword1")
+
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"ours at the end", first},
+		// Something else added after our IFD, so the payload can only be
+		// blanked where it is
+		{"something after", append(append([]byte{}, first...), make([]byte, 16)...)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			out := tiff_lock(t, tt.data, "SecondPassword2")
+			if n := bytes.Count(out, []byte(payload_prefix)); n != 1 {
+				t.Errorf("%d payloads in the relocked file, want 1", n)
+			}
+			if bytes.Contains(out, []byte("FirstPassword1")) {
+				t.Error("the old password is still in the file")
+			}
+			image, err := parse_tiff(out)
+			if err != nil {
+				t.Fatal(err)
+			}
+			info, err := extract_tiff_password(image)
+			if err != nil || info.Password != "SecondPassword2" {
+				t.Fatalf("extract_tiff_password = %q, %v", info.Password, err)
+			}
+			if !bytes.Equal(out[8:len(orig)], orig[8:]) {
+				t.Error("the original image data changed")
+			}
+		})
+	}
+	if again := tiff_lock(t, first, "OtherPassword1"); len(again) != len(first) {
+		t.Errorf("relocking grew the file from %d to %d bytes", len(first), len(again))
+	}
+}
@@ -0,0 +1,188 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"strconv"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// WebP lock images
+//
+// A WebP is a RIFF file: "RIFF", the size of the rest, "WEBP", then
+// chunks of a 4 byte type, 4 byte little endian size and the data
+// (padded to an even length).  A simple file is a single VP8 (lossy) or
+// VP8L (lossless) chunk; an extended one starts with a VP8X chunk
+// saying what else is there.  Only extended files may have other
+// chunks, so a simple file is turned into an extended one with a VP8X
+// chunk in front.  The image data itself is never touched; the payload
+// goes in a chunk of our own at the end, which decoders skip.
+//
+//////////////////////////////////////////////////////////////////////
+
+const webp_chunk = "PLCK"
+
+type WebP_Chunk struct {
+	kind string
+	data []byte
+}
+
+type WebP struct {
+	chunks  []WebP_Chunk
+	trailer []byte // anything after the end of the RIFF data
+}
+
+func is_webp(data []byte) bool {
+	return len(data) >= 12 && string(data[:4]) == "RIFF" && string(data[8:12]) == "WEBP"
+}
+
+func parse_webp(img []byte) (WebP, error) {
+	var image WebP
+	if !is_webp(img) {
+		return image, errors.New("Not a WebP file")
+	}
+
+	end := 8 + int(binary.LittleEndian.Uint32(img[4:]))
+	if end > len(img) || end < 12 {
+		return image, errors.New("Bad WebP - RIFF size runs past the end of the file")
+	}
+	image.trailer = img[end:]
+
+	offset := 12
+	for offset < end {
+		if offset+8 > end {
+			return image, errors.New("Bad WebP - truncated chunk header at " + strconv.Itoa(offset))
+		}
+		kind := string(img[offset : offset+4])
+		size := int(binary.LittleEndian.Uint32(img[offset+4:]))
+		data_end := offset + 8 + size
+		if size < 0 || data_end > end || data_end < offset {
+			return image, errors.New("Bad WebP - " + kind + " chunk at " + strconv.Itoa(offset) + " runs past the end of the file")
+		}
+		image.chunks = append(image.chunks, WebP_Chunk{kind, img[offset+8 : data_end]})
+		offset = data_end + size&1
+	}
+
+	if len(image.chunks) == 0 {
+		return image, errors.New("Bad WebP - no image data")
+	}
+	switch image.chunks[0].kind {
+	case "VP8 ", "VP8L", "VP8X":
+	default:
+		return image, errors.New("Bad WebP - starts with an unknown " + image.chunks[0].kind + " chunk")
+	}
+	return image, nil
+}
+
+func write_webp(f io.Writer, image WebP) error {
+	size := 4
+	for _, c := range image.chunks {
+		size += 8 + len(c.data) + len(c.data)&1
+	}
+	var head [12]byte
+	copy(head[:], "RIFF")
+	binary.LittleEndian.PutUint32(head[4:], uint32(size))
+	copy(head[8:], "WEBP")
+
+	out := [][]byte{head[:]}
+	for _, c := range image.chunks {
+		var ch [8]byte
+		copy(ch[:], c.kind)
+		binary.LittleEndian.PutUint32(ch[4:], uint32(len(c.data)))
+		out = append(out, ch[:], c.data)
+		if len(c.data)&1 == 1 {
+			out = append(out, []byte{0})
+		}
+	}
+	out = append(out, image.trailer)
+
+	for _, b := range out {
+		if _, err := f.Write(b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// The canvas size of a simple file, and whether it has transparency,
+// from the start of its VP8 or VP8L bitstream
+func webp_canvas(c WebP_Chunk) (int, int, bool, error) {
+	switch c.kind {
+	case "VP8 ":
+		// 3 byte frame tag, then a start code and 14 bit sizes
+		if len(c.data) < 10 || !bytes.Equal(c.data[3:6], []byte{0x9d, 0x01, 0x2a}) {
+			return 0, 0, false, errors.New("Bad WebP - damaged VP8 header")
+		}
+		w := int(binary.LittleEndian.Uint16(c.data[6:]) & 0x3fff)
+		h := int(binary.LittleEndian.Uint16(c.data[8:]) & 0x3fff)
+		return w, h, false, nil
+	case "VP8L":
+		// Signature byte, then 14 bits each of width-1 and height-1 and
+		// the alpha flag
+		if len(c.data) < 5 || c.data[0] != 0x2f {
+			return 0, 0, false, errors.New("Bad WebP - damaged VP8L header")
+		}
+		bits := binary.LittleEndian.Uint32(c.data[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, bits>>28&1 == 1, nil
+	}
+	return 0, 0, false, errors.New("Bad WebP - can not find the size of a " + c.kind + " image")
+}
+
+// Put a VP8X chunk in front of a simple file, so it can have more chunks
+func webp_extend(image *WebP) error {
+	if image.chunks[0].kind == "VP8X" {
+		return nil
+	}
+	w, h, alpha, err := webp_canvas(image.chunks[0])
+	if err != nil {
+		return err
+	}
+	vp8x := make([]byte, 10)
+	if alpha {
+		vp8x[0] = 0x10
+	}
+	vp8x[4], vp8x[5], vp8x[6] = byte(w-1), byte((w-1)>>8), byte((w-1)>>16)
+	vp8x[7], vp8x[8], vp8x[9] = byte(h-1), byte((h-1)>>8), byte((h-1)>>16)
+	image.chunks = append([]WebP_Chunk{{"VP8X", vp8x}}, image.chunks...)
+	return nil
+}
+
+// Find the chunk holding our payload
+func webp_payload(image WebP) ([]byte, bool) {
+	for _, c := range image.chunks {
+		if c.kind == webp_chunk && is_payload(c.data) {
+			return c.data, true
+		}
+	}
+	return nil, false
+}
+
+// Replace any old payload with a new one, at the end of the file
+func embed_webp_password(image *WebP, payload []byte) error {
+	if err := webp_extend(image); err != nil {
+		return err
+	}
+
+	var chunks []WebP_Chunk
+	for _, c := range image.chunks {
+		if c.kind == webp_chunk {
+			continue
+		}
+		chunks = append(chunks, c)
+	}
+	image.chunks = append(chunks, WebP_Chunk{webp_chunk, payload})
+	return nil
+}
+
+// Find the password in a WebP's chunk
+func extract_webp_password(image WebP) (LockInfo, error) {
+	payload, ok := webp_payload(image)
+	if !ok {
+		return LockInfo{}, no_payload
+	}
+	_, info, err := decode_payload(payload)
+	return info, err
+}
@@ -0,0 +1,120 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+func webp_test_chunk(kind string, data []byte) []byte {
+	var head [8]byte
+	copy(head[:], kind)
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(data)))
+	res := append(head[:], data...)
+	if len(data)&1 == 1 {
+		res = append(res, 0)
+	}
+	return res
+}
+
+func webp_test_file(chunks ...[]byte) []byte {
+	body := append([]byte("WEBP"), bytes.Join(chunks, nil)...)
+	var head [8]byte
+	copy(head[:], "RIFF")
+	binary.LittleEndian.PutUint32(head[4:], uint32(len(body)))
+	return append(head[:], body...)
+}
+
+// Just enough of each bitstream for webp_canvas: a 320x200 VP8, and a
+// 100x50 VP8L with alpha
+var webp_vp8 = append([]byte{0x10, 0x02, 0x00, 0x9d, 0x01, 0x2a, 0x40, 0x01, 0xc8, 0x00}, make([]byte, 37)...)
+var webp_vp8l = append([]byte{0x2f, 0x63, 0x40, 0x0c, 0x10}, make([]byte, 50)...)
+
+func TestWebPRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		file   []byte
+		width  int
+		height int
+		alpha  bool
+	}{
+		{"lossy", webp_test_file(webp_test_chunk("VP8 ", webp_vp8)), 320, 200, false},
+		{"lossless", webp_test_file(webp_test_chunk("VP8L", webp_vp8l)), 100, 50, true},
+		{"extended", webp_test_file(webp_test_chunk("VP8X", []byte{0x08, 0, 0, 0, 99, 0, 0, 49, 0, 0}), webp_test_chunk("VP8L", webp_vp8l), webp_test_chunk("EXIF", []byte("II*\x00z"))), 100, 50, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			image, err := parse_webp(tt.file)
+			if err != nil {
+				t.Fatal(err)
+			}
+			var buf bytes.Buffer
+			write_webp(&buf, image)
+			if !bytes.Equal(buf.Bytes(), tt.file) {
+				t.Fatal("parse and write didn't give back the same file")
+			}
+			orig := image.chunks
+
+			// Embedding twice leaves just the second payload
+			for _, psw := range []string{"FirstPassword1", "SecondPassword2"} {
+				if err := embed_webp_password(&image, encode_payload(psw, PayloadOptions{})); err != nil {
+					t.Fatal(err)
+				}
+			}
+			buf.Reset()
+			write_webp(&buf, image)
+
+			check, err := parse_webp(buf.Bytes())
+			if err != nil {
+				t.Fatalf("can't re-read the locked file: %v", err)
+			}
+			info, err := extract_webp_password(check)
+			if err != nil || info.Password != "SecondPassword2" {
+				t.Fatalf("extract_webp_password = %q, %v", info.Password, err)
+			}
+
+			// VP8X first, then the image's own chunks untouched, then ours
+			if check.chunks[0].kind != "VP8X" {
+				t.Fatalf("first chunk is %s, want VP8X", check.chunks[0].kind)
+			}
+			vp8x := check.chunks[0].data
+			w, h := 1+(int(vp8x[4])|int(vp8x[5])<<8|int(vp8x[6])<<16), 1+(int(vp8x[7])|int(vp8x[8])<<8|int(vp8x[9])<<16)
+			if alpha := vp8x[0]&0x10 != 0; w != tt.width || h != tt.height || alpha != tt.alpha {
+				t.Errorf("VP8X says %dx%d alpha %v, want %dx%d alpha %v", w, h, alpha, tt.width, tt.height, tt.alpha)
+			}
+			rest := check.chunks[1 : len(check.chunks)-1]
+			if orig[0].kind == "VP8X" {
+				orig = orig[1:]
+			}
+			if len(rest) != len(orig) {
+				t.Fatalf("%d chunks between VP8X and ours, want %d", len(rest), len(orig))
+			}
+			for i := range orig {
+				if rest[i].kind != orig[i].kind || !bytes.Equal(rest[i].data, orig[i].data) {
+					t.Errorf("%s chunk changed", orig[i].kind)
+				}
+			}
+			if last := check.chunks[len(check.chunks)-1]; last.kind != webp_chunk {
+				t.Errorf("last chunk is %s, want %s", last.kind, webp_chunk)
+			}
+		})
+	}
+}
+
+func TestWebPDamaged(t *testing.T) {
+	good := webp_test_file(webp_test_chunk("VP8L", webp_vp8l))
+	tests := map[string][]byte{
+		"not RIFF":        append([]byte("RIFX"), good[4:]...),
+		"RIFF too long":   append(append([]byte{}, good[:4]...), append([]byte{0xff, 0xff, 0, 0}, good[8:]...)...),
+		"chunk too long":  webp_test_file(append([]byte("VP8L\xff\x00\x00\x00"), webp_vp8l...)),
+		"no image":        webp_test_file(),
+		"unknown first":   webp_test_file(webp_test_chunk("ABCD", []byte{1, 2})),
+		"cut off":         good[:len(good)-10],
+		"truncated chunk": webp_test_file([]byte("VP8")),
+	}
+	for name, data := range tests {
+		if _, err := parse_webp(data); err == nil {
+			t.Errorf("%s: parse_webp succeeded", name)
+		}
+	}
+}
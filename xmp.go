@@ -0,0 +1,141 @@
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"picture_lock/carrier"
+	"regexp"
+	"strings"
+)
+
+//////////////////////////////////////////////////////////////////////
+//
+// XMP in JPEG lock images
+//
+// With -xmp the password goes in the image's XMP metadata rather than a
+// comment.  XMP is an XML packet in an APP1 segment, after a header
+// naming its namespace; there should only be one, so if the image has
+// one already our property is added to it.  It's given its own
+// rdf:Description so it can be found, and removed, without
+// understanding anything else in the packet.
+//
+//////////////////////////////////////////////////////////////////////
+
+// Should the password go into the XMP rather than the comment?
+var use_xmp bool
+
+const xmp_marker = 0xe1
+const xmp_header = "http://ns.adobe.com/xap/1.0/\x00"
+const xmp_ns = "https://github.com/bdsm-spuddy/emlalock-picture-safe/xmp/1.0/"
+
+// What we add to the packet, either side of the payload
+const xmp_open = `<rdf:Description rdf:about="" xmlns:plock="` + xmp_ns + `"><plock:Payload>`
+const xmp_close = `</plock:Payload></rdf:Description>`
+
+var xmp_ours = regexp.MustCompile(`(?s)` + regexp.QuoteMeta(xmp_open) + `.*?` + regexp.QuoteMeta(xmp_close) + `\n?`)
+
+// Where the XMP segment is, if there is one
+func xmp_segment(image carrier.JPEG) (int, bool) {
+	for i, s := range image.Segments {
+		if s.Marker == xmp_marker && bytes.HasPrefix(s.Data, []byte(xmp_header)) {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// Find our property in the XMP.  If a tool has rewritten the packet
+// and there's now more than one, the last is the one we added.
+func xmp_payload(image carrier.JPEG) ([]byte, bool) {
+	i, ok := xmp_segment(image)
+	if !ok {
+		return nil, false
+	}
+	d := xml.NewDecoder(bytes.NewReader(image.Segments[i].Data[len(xmp_header):]))
+
+	var res []byte
+	found := false
+	var text *bytes.Buffer
+	for {
+		tok, err := d.Token()
+		if err != nil {
+			break
+		}
+		switch t := tok.(type) {
+		case xml.StartElement:
+			if t.Name.Space == xmp_ns && t.Name.Local == "Payload" {
+				text = &bytes.Buffer{}
+			}
+		case xml.CharData:
+			if text != nil {
+				text.Write(t)
+			}
+		case xml.EndElement:
+			if text != nil {
+				res, found = text.Bytes(), true
+				text = nil
+			}
+		}
+	}
+	return res, found && is_payload(res)
+}
+
+// A packet holding nothing but our property
+func new_xmp_packet() string {
+	return `<?xpacket begin="` + "\xef\xbb\xbf" + `" id="W5M0MpCehiHzreSzNTczkc9d"?>` + "\n" +
+		`<x:xmpmeta xmlns:x="adobe:ns:meta/">` + "\n" +
+		`<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">` + "\n" +
+		`</rdf:RDF>` + "\n" +
+		`</x:xmpmeta>` + "\n" +
+		`<?xpacket end="w"?>`
+}
+
+// Replace any payload of ours in the XMP with this one, or just remove
+// it if payload is nil.  A packet that's only ours goes altogether.
+func set_xmp_payload(image *carrier.JPEG, payload []byte) error {
+	i, ok := xmp_segment(*image)
+	packet := new_xmp_packet()
+	if ok {
+		old := string(image.Segments[i].Data[len(xmp_header):])
+		packet = xmp_ours.ReplaceAllString(old, "")
+		if payload == nil && packet == old {
+			return nil
+		}
+		if payload == nil && packet == new_xmp_packet() {
+			image.Segments = append(image.Segments[:i:i], image.Segments[i+1:]...)
+			return nil
+		}
+	} else if payload == nil {
+		return nil
+	}
+
+	if payload != nil {
+		end := strings.LastIndex(packet, "</rdf:RDF>")
+		if end == -1 {
+			return errors.New("The image's XMP has no rdf:RDF element to add the password to")
+		}
+		var buf bytes.Buffer
+		xml.EscapeText(&buf, payload)
+		packet = packet[:end] + xmp_open + buf.String() + xmp_close + "\n" + packet[end:]
+	}
+
+	data := []byte(xmp_header + packet)
+	if len(data) > 0xffff-2 {
+		return errors.New("The image's XMP is too big to add the password to")
+	}
+	seg := carrier.Segment{Marker: xmp_marker, Data: data}
+	if ok {
+		// A copy, so the source image's segments aren't changed
+		image.Segments = append(append(append([]carrier.Segment{}, image.Segments[:i]...), seg), image.Segments[i+1:]...)
+		return nil
+	}
+
+	// After JFIF and EXIF, which want to come first
+	at := 0
+	for at < len(image.Segments) && (image.Segments[at].Marker == 0xe0 || image.Segments[at].Marker == xmp_marker) {
+		at++
+	}
+	image.Segments = append(append(append([]carrier.Segment{}, image.Segments[:at]...), seg), image.Segments[at:]...)
+	return nil
+}